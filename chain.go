@@ -0,0 +1,85 @@
+package subsurface_stream
+
+import (
+	"errors"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gchange/subsurface-stream/ratelimit"
+	"github.com/gchange/subsurface-stream/steam"
+	"github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"sync"
+)
+
+type Chain struct {
+	*Config
+	Streams []stream.Config
+	rateLimit *ratelimit.Group
+	refs sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func (config *Config) NewChain() (*Chain, error) {
+	var err error
+	if config.MaxConnections < 0 || config.MaxConnectionsPerIP < 0 {
+		return nil, errors.New("invalid connection limit")
+	}
+	chain := &Chain{Config: config}
+	if config.RateLimit != nil {
+		err = config.RateLimit.Init()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var errs parser.Errors
+	chain.Streams = make([]stream.Config, 0, len(config.Configs))
+	for i, m := range config.Configs {
+		s, err := stream.GetStreamConfig(m)
+		if err == nil {
+			err = s.Init()
+		}
+		if err != nil {
+			errs.Add(parser.Prefix("config["+strconv.Itoa(i)+"]", err))
+			continue
+		}
+		chain.Streams = append(chain.Streams, s)
+	}
+	if len(errs) > 0 {
+		chain.Close()
+		return nil, errs.Err()
+	}
+	chain.rateLimit = config.RateLimit.New()
+	return chain, nil
+}
+
+func (chain *Chain) Reload() error {
+	var err error
+	for _, s := range chain.Streams {
+		if reloader, ok := s.(stream.Reloader); ok {
+			if e := reloader.Reload(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (chain *Chain) Close() error {
+	var err error
+	chain.closeOnce.Do(func() {
+		for _, s := range chain.Streams {
+			if closer, ok := s.(io.Closer); ok {
+				if e := closer.Close(); e != nil {
+					logrus.WithError(e).Debug("fail to close stream")
+					err = e
+				}
+			}
+		}
+	})
+	return err
+}
+
+func (chain *Chain) drain() {
+	chain.refs.Wait()
+	chain.Close()
+}
@@ -0,0 +1,76 @@
+package dialer
+
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/ratelimit"
+	"io"
+	"net"
+	"time"
+)
+
+const DefaultDialTimeout = 30 * time.Second
+
+type Metadata struct {
+	Listener string
+	Source net.Addr
+	User string
+	RateLimit *ratelimit.Group
+	DialTimeout time.Duration
+}
+
+type metadataKey struct{}
+
+type watchResult struct {
+	data []byte
+	err error
+}
+
+func WithMetadata(ctx context.Context, metadata *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+func MetadataFromContext(ctx context.Context) (*Metadata, bool) {
+	metadata, ok := ctx.Value(metadataKey{}).(*Metadata)
+	return metadata, ok
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func clientGone(err error) bool {
+	return err != nil && err != io.EOF && !isTimeout(err)
+}
+
+func WatchClient(ctx context.Context, client net.Conn) (context.Context, func() ([]byte, error)) {
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); ok {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		timeout := DefaultDialTimeout
+		if metadata, ok := MetadataFromContext(ctx); ok && metadata.DialTimeout > 0 {
+			timeout = metadata.DialTimeout
+		}
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	result := make(chan watchResult, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, err := client.Read(buf)
+		if clientGone(err) {
+			cancel()
+		}
+		result <- watchResult{buf[:n], err}
+	}()
+	return ctx, func() ([]byte, error) {
+		client.SetReadDeadline(time.Unix(1, 0))
+		r := <-result
+		client.SetDeadline(time.Time{})
+		cancel()
+		if clientGone(r.err) {
+			return r.data, r.err
+		}
+		return r.data, nil
+	}
+}
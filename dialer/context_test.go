@@ -0,0 +1,96 @@
+package dialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestWatchClientHalfClose(t *testing.T) {
+	client, server := tcpPair(t)
+	ctx, stop := WatchClient(context.Background(), server)
+	client.CloseWrite()
+	time.Sleep(50 * time.Millisecond)
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("half-closed client canceled the dial: %v", err)
+	}
+	data, err := stop()
+	if len(data) != 0 || err != nil {
+		t.Fatalf("got (%q, %v), want no data and no error", data, err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("relay read got %v, want EOF", err)
+	}
+	if _, err := server.Write([]byte("banner")); err != nil {
+		t.Fatalf("write to a half-closed client: %v", err)
+	}
+	server.CloseWrite()
+	buf, err := io.ReadAll(client)
+	if err != nil || string(buf) != "banner" {
+		t.Fatalf("got (%q, %v), want the banner", buf, err)
+	}
+}
+
+func TestWatchClientReset(t *testing.T) {
+	client, server := tcpPair(t)
+	ctx, stop := WatchClient(context.Background(), server)
+	client.SetLinger(0)
+	client.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset client did not cancel the dial")
+	}
+	if _, err := stop(); err == nil {
+		t.Fatal("stop returned no error for a reset client")
+	}
+}
+
+func TestWatchClientData(t *testing.T) {
+	client, server := tcpPair(t)
+	server.SetWriteDeadline(time.Unix(1, 0))
+	ctx, stop := WatchClient(WithMetadata(context.Background(), &Metadata{DialTimeout: time.Minute}), server)
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Fatalf("dial deadline %v, want within the configured minute", deadline)
+	}
+	client.Write([]byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	data, err := stop()
+	if string(data) != "h" || err != nil {
+		t.Fatalf("got (%q, %v), want (\"h\", nil)", data, err)
+	}
+	if err := ctx.Err(); err != context.Canceled {
+		t.Fatalf("context after stop: %v", err)
+	}
+	if _, err := server.Write([]byte("ok")); err != nil {
+		t.Fatalf("write deadline kept after stop: %v", err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ello" {
+		t.Fatalf("got (%q, %v)", buf, err)
+	}
+}
@@ -1,16 +1,21 @@
 package dialer
 
 import (
+	"context"
 	"errors"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/parser"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"strconv"
 	"time"
 )
 
 type CounterConfig struct {
-	Interval string `subsurface:"interval"`
-	Dialer map[string]interface{} `subsurface:"dialer"`
+	Interval string `subsurface:"interval" description:"interval between traffic counter log lines, empty disables logging"`
+	Label string `subsurface:"label" description:"label of the traffic metrics"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer to count traffic for"`
 	interval time.Duration
 	dialerConfig Config
 }
@@ -20,48 +25,55 @@ type Counter struct {
 	dialer Dialer
 	ch chan [2]string
 	ticker *time.Ticker
+	done chan struct{}
 }
 
 func (config *CounterConfig) Init() error {
-	intervalLen := len(config.Interval)
-	if config.Interval == "" || intervalLen <= 1 {
-		return errors.New("invalid interval")
+	var err error
+	if config.Interval != "" {
+		if config.interval, err = parseInterval(config.Interval); err != nil {
+			return err
+		}
+	}
+	config.dialerConfig, err = GetDialerConfig(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
 	}
+	return parser.Prefix("dialer", config.dialerConfig.Init())
+}
+
+func parseInterval(s string) (time.Duration, error) {
+	intervalLen := len(s)
 	var interval string
 	var duration time.Duration
 	switch {
-	case config.Interval[intervalLen-1] == 's' || config.Interval[intervalLen-1] == 'S':
-		interval = config.Interval[:intervalLen-1]
+	case s[intervalLen-1] == 's' || s[intervalLen-1] == 'S':
+		interval = s[:intervalLen-1]
 		duration = time.Second
-	case config.Interval[intervalLen-1] == 'm' || config.Interval[intervalLen-1] == 'M':
-		interval = config.Interval[:intervalLen-1]
+	case s[intervalLen-1] == 'm' || s[intervalLen-1] == 'M':
+		interval = s[:intervalLen-1]
 		duration = time.Minute
-	case config.Interval[intervalLen-1] == 'h' || config.Interval[intervalLen-1] == 'H':
-		interval = config.Interval[:intervalLen-1]
+	case s[intervalLen-1] == 'h' || s[intervalLen-1] == 'H':
+		interval = s[:intervalLen-1]
 		duration = time.Hour
 	default:
-		interval = config.Interval
+		interval = s
 		duration = time.Millisecond
 	}
 	t, err := strconv.Atoi(interval)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	config.interval = time.Duration(t)*duration
-	config.dialerConfig, err = GetDialerConfig(config.Dialer)
-	if err != nil {
-		return err
-	}
-	err = config.dialerConfig.Init()
-	if err != nil {
-		return err
+	if t <= 0 {
+		return 0, errors.New("invalid interval")
 	}
-	return nil
+	return time.Duration(t)*duration, nil
 }
 
 func (config *CounterConfig) Clone() Config {
 	return &CounterConfig{
 		Interval:config.Interval,
+		Label:config.Label,
 		Dialer:config.Dialer,
 		interval: config.interval,
 		dialerConfig:config.dialerConfig,
@@ -77,23 +89,36 @@ func (config *CounterConfig) New() (Dialer, error) {
 		config,
 		dialer,
 		make(chan [2]string, 512),
-		time.NewTicker(config.interval),
+		nil,
+		make(chan struct{}),
+	}
+	if config.interval > 0 {
+		counter.ticker = time.NewTicker(config.interval)
+		go counter.count()
 	}
-	go counter.count()
 	return counter, nil
 }
 
-func (counter *Counter) Dial(network, address string) (net.Conn, error) {
-	select {
-	case counter.ch<-[2]string{network, address}:
-	default:
-		fields := logrus.Fields{
-			"network": network,
-			"address": address,
+func (counter *Counter) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if counter.ticker != nil {
+		select {
+		case counter.ch<-[2]string{network, address}:
+		default:
+			fields := logrus.Fields{
+				"network": network,
+				"address": address,
+			}
+			Logger.WithFields(fields).Info("add counter failed")
 		}
-		logrus.WithFields(fields).Info("add counter failed")
 	}
-	return counter.dialer.Dial(network, address)
+	start := time.Now()
+	conn, err := counter.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		metrics.DialErrors.WithLabelValues(counter.Label, metrics.Reason(err)).Inc()
+		return nil, err
+	}
+	metrics.DialDuration.WithLabelValues(counter.Label, network).Observe(time.Since(start).Seconds())
+	return conn, nil
 }
 
 func (counter *Counter) count() {
@@ -113,19 +138,34 @@ func (counter *Counter) count() {
 					d[val[1]] = 1
 				}
 			} else {
-				logrus.WithField("key", val[0]).Error("wrong counter type")
+				Logger.WithField("key", val[0]).Error("wrong counter type")
 				delete(fields, val[0])
 			}
 			case <-counter.ticker.C:
 				if len(fields) != 0 {
-					logrus.WithFields(fields).Info("counter")
+					Logger.WithFields(fields).Info("counter")
 					fields = logrus.Fields{}
 				}
+			case <-counter.done:
+				return
 		}
 	}
 }
 
+func (counter *Counter) Close() error {
+	if counter.ticker != nil {
+		counter.ticker.Stop()
+	}
+	close(counter.done)
+	if closer, ok := counter.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func init() {
-	config := &CounterConfig{}
+	config := &CounterConfig{
+		Label: "counter",
+	}
 	Register("counter", config)
 }
@@ -0,0 +1,66 @@
+package dialer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterInterval(t *testing.T) {
+	cases := map[string]time.Duration{
+		"500": 500 * time.Millisecond,
+		"1S":  time.Second,
+		"1M":  time.Minute,
+		"2h":  2 * time.Hour,
+	}
+	for interval, want := range cases {
+		config, err := GetDialerConfig(map[string]interface{}{
+			"name":     "counter",
+			"interval": interval,
+			"dialer":   map[string]interface{}{"name": "direct"},
+		})
+		if err != nil {
+			t.Fatalf("interval %q: %v", interval, err)
+		}
+		if err := config.Init(); err != nil {
+			t.Fatalf("interval %q: %v", interval, err)
+		}
+		if got := config.(*CounterConfig).interval; got != want {
+			t.Fatalf("interval %q parsed as %v, want %v", interval, got, want)
+		}
+	}
+}
+
+func TestCounterWithoutInterval(t *testing.T) {
+	config, err := GetDialerConfig(map[string]interface{}{
+		"name":   "counter",
+		"dialer": map[string]interface{}{"name": "direct"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Init(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := config.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter := d.(*Counter); counter.ticker != nil {
+		t.Fatal("empty interval started the counter log")
+	}
+	d.(*Counter).Close()
+
+	for _, interval := range []string{"0", "-1s", "s"} {
+		config, err := GetDialerConfig(map[string]interface{}{
+			"name":     "counter",
+			"interval": interval,
+			"dialer":   map[string]interface{}{"name": "direct"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Init(); err == nil {
+			t.Fatalf("interval %q accepted", interval)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package dialer
 
 import (
+	"context"
 	"github.com/gchange/subsurface-stream/parser"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"net"
 	"reflect"
+	"sort"
 	"sync"
 )
 
 var (
+	Logger = logrus.StandardLogger()
 	lock = sync.RWMutex{}
 	dialerPool = map[string]Config{}
 )
@@ -20,7 +24,11 @@ type Config interface {
 }
 
 type Dialer interface {
-	Dial(string, string) (net.Conn, error)
+	DialContext(context.Context, string, string) (net.Conn, error)
+}
+
+type Warmer interface {
+	Warm(network, address string)
 }
 
 func Register(name string, config Config) error {
@@ -46,11 +54,61 @@ func GetDialerConfig(config map[string]interface{}) (Config, error) {
 	defer lock.RUnlock()
 	if c, ok := dialerPool[name]; ok {
 		nc := c.Clone()
-		err := parser.Unmarshal("subsurface", reflect.ValueOf(nc), config)
+		err := parser.Unmarshal("subsurface", reflect.ValueOf(nc), config, "name")
 		if err != nil {
 			return nil, err
 		}
 		return nc, nil
 	}
-	return nil, errors.New("config not found")
+	return nil, parser.UnknownName("dialer", name, names())
+}
+
+func names() []string {
+	list := make([]string, 0, len(dialerPool))
+	for name := range dialerPool {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func Names() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return names()
+}
+
+func init() {
+	parser.RegisterKind("dialer", "subsurface", prototype)
+}
+
+func prototype(name string) (interface{}, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if c, ok := dialerPool[name]; ok {
+		return c.Clone(), true
+	}
+	return nil, false
+}
+
+func Configs() map[string]Config {
+	lock.RLock()
+	defer lock.RUnlock()
+	configs := make(map[string]Config, len(dialerPool))
+	for name, config := range dialerPool {
+		configs[name] = config.Clone()
+	}
+	return configs
+}
+
+func New(config map[string]interface{}) (Dialer, error) {
+	dialerConfig, err := GetDialerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	err = dialerConfig.Init()
+	if err != nil {
+		return nil, err
+	}
+	return dialerConfig.New()
 }
@@ -1,20 +1,87 @@
 package dialer
 
-import "net"
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gchange/subsurface-stream/resolver"
+	"net"
+	"time"
+)
 
 type DirectConfig struct {
+	Resolver map[string]interface{} `subsurface:"resolver" schema:"resolver" description:"resolver used instead of the system one"`
+	Prefer string `subsurface:"prefer" validate:"oneof=ipv4 ipv6" description:"address family tried first"`
+	Timeout time.Duration `subsurface:"timeout" description:"connect timeout"`
+	resolverConfig resolver.Config
+}
+
+type Direct struct {
+	*DirectConfig
+	dialer *net.Dialer
+	resolver resolver.Resolver
 }
 
 func (config *DirectConfig) Init() error {
-	return nil
+	var err error
+	if config.Resolver == nil {
+		return nil
+	}
+	config.resolverConfig, err = resolver.GetResolverConfig(config.Resolver)
+	if err != nil {
+		return parser.Prefix("resolver", err)
+	}
+	return parser.Prefix("resolver", config.resolverConfig.Init())
 }
 
 func (config *DirectConfig) Clone() Config {
-	return &DirectConfig{}
+	return &DirectConfig{
+		Resolver: config.Resolver,
+		Prefer: config.Prefer,
+		Timeout: config.Timeout,
+		resolverConfig: config.resolverConfig,
+	}
 }
 
 func (config *DirectConfig) New() (Dialer, error) {
-	return &net.Dialer{}, nil
+	direct := &Direct{
+		DirectConfig: config,
+		dialer: &net.Dialer{Timeout: config.Timeout},
+	}
+	if config.resolverConfig != nil {
+		var err error
+		direct.resolver, err = config.resolverConfig.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return direct, nil
+}
+
+func (direct *Direct) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || direct.resolver == nil || net.ParseIP(host) != nil {
+		return direct.dialer.DialContext(ctx, network, address)
+	}
+	if direct.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, direct.Timeout)
+		defer cancel()
+	}
+	ips, err := direct.resolver.LookupIP(ctx, resolver.IPNetwork(network), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	for _, ip := range resolver.Sort(ips, direct.Prefer) {
+		var conn net.Conn
+		conn, err = direct.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
 }
 
 func init() {
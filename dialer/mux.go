@@ -0,0 +1,132 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/hashicorp/yamux"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+type MuxConfig struct {
+	KeepAlive time.Duration `subsurface:"keep_alive" default:"30s" description:"interval of the keep-alive pings on each session"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer used for the shared connection"`
+	dialerConfig Config
+}
+
+type Mux struct {
+	*MuxConfig
+	dialer Dialer
+	sessions map[string]*yamux.Session
+	closed bool
+	lock sync.Mutex
+}
+
+func MuxSessionConfig(keepAlive time.Duration) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	if keepAlive > 0 {
+		config.KeepAliveInterval = keepAlive
+	} else {
+		config.EnableKeepAlive = false
+	}
+	return config
+}
+
+func (config *MuxConfig) Init() error {
+	if config.KeepAlive < 0 {
+		return errors.New("invalid keep alive interval")
+	}
+	var err error
+	config.dialerConfig, err = GetDialerConfig(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
+	}
+	return parser.Prefix("dialer", config.dialerConfig.Init())
+}
+
+func (config *MuxConfig) Clone() Config {
+	return &MuxConfig{
+		KeepAlive: config.KeepAlive,
+		Dialer: config.Dialer,
+		dialerConfig: config.dialerConfig,
+	}
+}
+
+func (config *MuxConfig) New() (Dialer, error) {
+	dialer, err := config.dialerConfig.New()
+	if err != nil {
+		return nil, err
+	}
+	return &Mux{
+		MuxConfig: config,
+		dialer: dialer,
+		sessions: make(map[string]*yamux.Session, 0),
+	}, nil
+}
+
+func (m *Mux) session(ctx context.Context, network, address string) (*yamux.Session, error) {
+	key := network + "/" + address
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, errors.New("mux dialer closed")
+	}
+	if session, ok := m.sessions[key]; ok && !session.IsClosed() {
+		return session, nil
+	}
+	conn, err := m.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	session, err := yamux.Client(conn, MuxSessionConfig(m.KeepAlive))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m.sessions[key] = session
+	return session, nil
+}
+
+func (m *Mux) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	for retry := 0; ; retry++ {
+		session, err := m.session(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		session.Close()
+		if retry > 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		Logger.WithError(err).WithField("address", address).Debug("mux session broken, redial")
+	}
+}
+
+func (m *Mux) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for key, session := range m.sessions {
+		session.Close()
+		delete(m.sessions, key)
+	}
+	if closer, ok := m.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	Register("mux", &MuxConfig{})
+}
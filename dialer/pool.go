@@ -1,32 +1,44 @@
 package dialer
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"github.com/sirupsen/logrus"
+	"github.com/gchange/subsurface-stream/parser"
+	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type PoolConfig struct {
-	IdleTime uint `subsurface:"idle_time"`
-	MaxConnect uint `subsurface:"max_connect"`
-	Dialer map[string]interface{} `subsurface:"dialer"`
+	MinIdle uint `subsurface:"min_idle" description:"idle connections kept open per address"`
+	MaxIdle uint `subsurface:"max_idle" description:"maximum idle connections per address"`
+	IdleTTL time.Duration `subsurface:"idle_ttl" default:"30s" description:"lifetime of an idle connection"`
+	CheckInterval time.Duration `subsurface:"check_interval" default:"5s" description:"interval between pool refills"`
+	TLS bool `subsurface:"tls" description:"wrap pooled connections in TLS"`
+	ServerName string `subsurface:"server_name" description:"TLS server name, defaults to the dialed host"`
+	Insecure bool `subsurface:"insecure" description:"skip TLS certificate verification"`
+	Warm []string `subsurface:"warm" description:"addresses pre-dialed when the pool starts and kept warm while idle"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer used to open pooled connections"`
 	dialerConfig Config
 }
 
-type conn struct {
+type idleConn struct {
 	net.Conn
-	ch chan *conn
+	created time.Time
 }
 
 type pool struct {
 	network string
 	address string
-	ch chan *conn
-	flag int32
-	ticker *time.Ticker
+	ch chan *idleConn
+	lastUsed int64
+	filling int32
+	closed int32
+	pinned bool
 }
 
 type Pool struct {
@@ -34,25 +46,43 @@ type Pool struct {
 	dialer Dialer
 	pool map[[2]string]*pool
 	lock sync.RWMutex
+	ticker *time.Ticker
+	done chan struct{}
+	closed bool
 }
 
+var errPoolClosed = errors.New("pool closed")
+
 func (config *PoolConfig) Init() error {
 	var err error
-	config.dialerConfig, err = GetDialerConfig(config.Dialer)
-	if err != nil {
-		return err
+	if config.MaxIdle == 0 || config.MinIdle > config.MaxIdle {
+		return errors.New("invalid pool size")
 	}
-	err = config.dialerConfig.Init()
+	if config.CheckInterval <= 0 {
+		return errors.New("invalid check interval")
+	}
+	for i, address := range config.Warm {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return parser.Prefix("warm["+strconv.Itoa(i)+"]", err)
+		}
+	}
+	config.dialerConfig, err = GetDialerConfig(config.Dialer)
 	if err != nil {
-		return err
+		return parser.Prefix("dialer", err)
 	}
-	return nil
+	return parser.Prefix("dialer", config.dialerConfig.Init())
 }
 
 func (config *PoolConfig) Clone() Config {
 	return &PoolConfig{
-		IdleTime:config.IdleTime,
-		MaxConnect:config.MaxConnect,
+		MinIdle:config.MinIdle,
+		MaxIdle:config.MaxIdle,
+		IdleTTL:config.IdleTTL,
+		CheckInterval:config.CheckInterval,
+		TLS:config.TLS,
+		ServerName:config.ServerName,
+		Insecure:config.Insecure,
+		Warm:config.Warm,
 		Dialer:config.Dialer,
 		dialerConfig:config.dialerConfig,
 	}
@@ -63,128 +93,228 @@ func (config *PoolConfig) New() (Dialer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Pool{
-		config,
-		dialer,
-		make(map[[2]string]*pool, 0),
-		sync.RWMutex{},
-	}, nil
-}
-
-func (c *conn) Close() error {
-	select {
-	case c.ch <- c:
-		return nil
-	default:
-		logrus.Error("push connect back to poll failed")
-		return c.Close()
+	p := &Pool{
+		PoolConfig: config,
+		dialer: dialer,
+		pool: make(map[[2]string]*pool, 0),
+		ticker: time.NewTicker(config.CheckInterval),
+		done: make(chan struct{}),
 	}
+	for _, address := range config.Warm {
+		p.Warm("tcp", address)
+	}
+	go p.maintain()
+	return p, nil
 }
 
-func (p *pool) get() net.Conn {
-	atomic.CompareAndSwapInt32(&p.flag, 0, 1)
-	select {
-	case conn := <- p.ch:
-		return conn
-	default:
-		return nil
+func (p *Pool) Warm(network, address string) {
+	sp, err := p.get(network, address)
+	if err != nil {
+		return
 	}
-
+	p.lock.Lock()
+	sp.pinned = true
+	p.lock.Unlock()
+	p.fill(sp)
 }
 
-func (p *pool) new(dialer Dialer, network, address string) (net.Conn, error) {
-	if network != p.network || address != p.address {
-		return nil, errors.New("can not create difference connection in a pool")
+func (p *Pool) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !p.TLS {
+		return conn, nil
 	}
-	c := p.get()
-	if c != nil {
-		return c, nil
+	serverName := p.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(address)
 	}
-	c, err := dialer.Dial(network, address)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		InsecureSkipVerify: p.Insecure,
+	})
+	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	c2 := &conn{c,p.ch}
-	select {
-	case p.ch<- c2:
-		return c2, nil
-	default:
-		return c, nil
-	}
+	return tlsConn, nil
 }
 
-func (p *pool) release() {
-	if !atomic.CompareAndSwapInt32(&p.flag, 1, 0) {
-		for conn := range p.ch {
-			if err := conn.Conn.Close(); err != nil {
-				logrus.WithError(err).Debug("close connection in pool failed")
-			}
-		}
-	}
+func (p *Pool) expired(conn *idleConn) bool {
+	return time.Since(conn.created) > p.IdleTTL
 }
 
-func (p *pool) close() {
-	p.ticker.Stop()
-	close(p.ch)
-	for conn := range p.ch {
-		if err := conn.Conn.Close(); err != nil {
-			logrus.WithError(err).Debug("close connection in pool failed")
-		}
-	}
+func (p *Pool) alive(conn *idleConn) bool {
+	return !p.expired(conn) && peek(conn.Conn)
 }
 
-func (p *Pool) Dial(network, address string) (net.Conn, error) {
+func (p *Pool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	sp, err := p.get(network, address)
 	if err != nil {
 		return nil, err
 	}
-	if sp == nil {
-		sp, err = p.create(network, address)
-		if err != nil {
-			return nil, err
+	defer p.fill(sp)
+	for {
+		var conn *idleConn
+		select {
+		case conn = <-sp.ch:
+		default:
+			return p.dial(ctx, network, address)
 		}
+		if p.alive(conn) {
+			return conn.Conn, nil
+		}
+		conn.Close()
 	}
-	if sp == nil {
-		return nil, errors.New("create connection poll failed")
-	}
-	conn, err := sp.new(p.dialer, network, address)
-	if err != nil {
-		return nil, err
-	}
-	return conn, nil
 }
 
 func (p *Pool) get(network, address string) (*pool, error) {
 	key := [2]string{network, address}
 	p.lock.RLock()
-	defer p.lock.RUnlock()
-	if sp, ok := p.pool[key]; ok {
+	sp, ok := p.pool[key]
+	if ok {
+		atomic.StoreInt64(&sp.lastUsed, time.Now().UnixNano())
+	}
+	closed := p.closed
+	p.lock.RUnlock()
+	if closed {
+		return nil, errPoolClosed
+	}
+	if ok {
 		return sp, nil
 	}
-	return nil, nil
-}
 
-func (p *Pool) create(network, address string) (*pool, error) {
-	key := [2]string{network, address}
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
 	if sp, ok := p.pool[key]; ok {
+		atomic.StoreInt64(&sp.lastUsed, time.Now().UnixNano())
 		return sp, nil
 	}
-	ch := make(chan *conn, p.MaxConnect)
-	ticker := time.NewTicker(time.Duration(p.IdleTime)*time.Second)
-	sp := &pool{
-		network:network,
-		address:address,
-		ch: ch,
-		ticker:ticker,
-		flag:0,
+	sp = &pool{
+		network: network,
+		address: address,
+		ch: make(chan *idleConn, p.MaxIdle),
+		lastUsed: time.Now().UnixNano(),
+	}
+	p.pool[key] = sp
+	return sp, nil
+}
+
+func (p *Pool) fill(sp *pool) {
+	if !atomic.CompareAndSwapInt32(&sp.filling, 0, 1) {
+		return
 	}
 	go func() {
-		for range sp.ticker.C {
-			sp.release()
+		defer atomic.StoreInt32(&sp.filling, 0)
+		for uint(len(sp.ch)) < p.MinIdle && atomic.LoadInt32(&sp.closed) == 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), p.CheckInterval)
+			conn, err := p.dial(ctx, sp.network, sp.address)
+			cancel()
+			if err != nil {
+				Logger.WithError(err).WithField("address", sp.address).Debug("pre-dial connection failed")
+				return
+			}
+			select {
+			case sp.ch <- &idleConn{conn, time.Now()}:
+			default:
+				conn.Close()
+				return
+			}
+			if atomic.LoadInt32(&sp.closed) != 0 {
+				sp.close()
+				return
+			}
 		}
 	}()
-	p.pool[key] = sp
-	return sp, nil
+}
+
+func (sp *pool) check(alive func(*idleConn) bool) {
+	for i := len(sp.ch); i > 0; i-- {
+		select {
+		case conn := <-sp.ch:
+			if !alive(conn) {
+				conn.Close()
+				continue
+			}
+			select {
+			case sp.ch <- conn:
+			default:
+				conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (sp *pool) close() {
+	atomic.StoreInt32(&sp.closed, 1)
+	for {
+		select {
+		case conn := <-sp.ch:
+			if err := conn.Close(); err != nil {
+				Logger.WithError(err).Debug("close connection in pool failed")
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pool) maintain() {
+	for {
+		select {
+		case <-p.ticker.C:
+		case <-p.done:
+			return
+		}
+		p.lock.Lock()
+		pools := make([]*pool, 0, len(p.pool))
+		for key, sp := range p.pool {
+			if !sp.pinned && time.Since(time.Unix(0, atomic.LoadInt64(&sp.lastUsed))) > p.IdleTTL {
+				delete(p.pool, key)
+				sp.close()
+				continue
+			}
+			pools = append(pools, sp)
+		}
+		p.lock.Unlock()
+		for _, sp := range pools {
+			sp.check(p.alive)
+			p.fill(sp)
+		}
+	}
+}
+
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.ticker.Stop()
+	close(p.done)
+	for key, sp := range p.pool {
+		delete(p.pool, key)
+		sp.close()
+	}
+	p.lock.Unlock()
+	if closer, ok := p.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	config := &PoolConfig{
+		MinIdle: 2,
+		MaxIdle: 8,
+	}
+	Register("pool", config)
 }
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package dialer
+
+import (
+	"net"
+)
+
+func peek(conn net.Conn) bool {
+	return true
+}
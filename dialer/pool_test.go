@@ -0,0 +1,123 @@
+package dialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, warm ...string) *Pool {
+	config := &PoolConfig{
+		MinIdle:       1,
+		MaxIdle:       2,
+		IdleTTL:       time.Minute,
+		CheckInterval: time.Hour,
+		Warm:          warm,
+		Dialer:        map[string]interface{}{"name": "direct"},
+	}
+	if err := config.Init(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := config.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.(*Pool).Close() })
+	return d.(*Pool)
+}
+
+func acceptAll(t *testing.T, l net.Listener) chan net.Conn {
+	conns := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return conns
+}
+
+func listenPool(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func waitIdle(t *testing.T, p *Pool, address string, n int) *pool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.lock.RLock()
+		sp := p.pool[[2]string{"tcp", address}]
+		p.lock.RUnlock()
+		if sp != nil && len(sp.ch) >= n {
+			return sp
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pool for %s never reached %d idle connections", address, n)
+	return nil
+}
+
+func TestPoolWarmsInNew(t *testing.T) {
+	l := listenPool(t)
+	conns := acceptAll(t, l)
+	newTestPool(t, l.Addr().String())
+	select {
+	case <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("warm address was not pre-dialed")
+	}
+}
+
+func TestPoolSkipsClosedConnections(t *testing.T) {
+	l := listenPool(t)
+	conns := acceptAll(t, l)
+	p := newTestPool(t, l.Addr().String())
+	waitIdle(t, p, l.Addr().String(), 1)
+	(<-conns).Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := p.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := <-conns
+	defer server.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got (%q, %v), a closed connection was handed out", buf, err)
+	}
+}
+
+func TestPoolDialAfterClose(t *testing.T) {
+	l := listenPool(t)
+	acceptAll(t, l)
+	p := newTestPool(t, l.Addr().String())
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.DialContext(context.Background(), "tcp", l.Addr().String()); err != errPoolClosed {
+		t.Fatalf("got %v, want %v", err, errPoolClosed)
+	}
+	p.Warm("tcp", l.Addr().String())
+	if len(p.pool) != 0 {
+		t.Fatalf("closed pool kept %d addresses", len(p.pool))
+	}
+}
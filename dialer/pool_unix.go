@@ -0,0 +1,41 @@
+//go:build unix
+
+package dialer
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+)
+
+func peek(conn net.Conn) bool {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var n int
+	var readErr error
+	buf := make([]byte, 1)
+	err = raw.Read(func(fd uintptr) bool {
+		n, _, readErr = syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true
+	})
+	if err != nil {
+		return false
+	}
+	if readErr == syscall.EAGAIN || readErr == syscall.EWOULDBLOCK {
+		return true
+	}
+	if readErr != nil || n == 0 {
+		return false
+	}
+	return isTLS
+}
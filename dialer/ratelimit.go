@@ -0,0 +1,83 @@
+package dialer
+
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gchange/subsurface-stream/ratelimit"
+	"io"
+	"net"
+)
+
+type RateLimitConfig struct {
+	Upload int64 `subsurface:"upload" description:"upload limit in bytes per second, 0 is unlimited"`
+	Download int64 `subsurface:"download" description:"download limit in bytes per second, 0 is unlimited"`
+	Burst int64 `subsurface:"burst" description:"bucket size in bytes, defaults to one second of traffic"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer to limit"`
+	limitConfig *ratelimit.Config
+	dialerConfig Config
+}
+
+type RateLimit struct {
+	*RateLimitConfig
+	dialer Dialer
+	limit *ratelimit.Limit
+}
+
+func (config *RateLimitConfig) Init() error {
+	config.limitConfig = &ratelimit.Config{
+		Upload: config.Upload,
+		Download: config.Download,
+		Burst: config.Burst,
+	}
+	err := config.limitConfig.Init()
+	if err != nil {
+		return err
+	}
+	config.dialerConfig, err = GetDialerConfig(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
+	}
+	return parser.Prefix("dialer", config.dialerConfig.Init())
+}
+
+func (config *RateLimitConfig) Clone() Config {
+	return &RateLimitConfig{
+		Upload: config.Upload,
+		Download: config.Download,
+		Burst: config.Burst,
+		Dialer: config.Dialer,
+		limitConfig: config.limitConfig,
+		dialerConfig: config.dialerConfig,
+	}
+}
+
+func (config *RateLimitConfig) New() (Dialer, error) {
+	dialer, err := config.dialerConfig.New()
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimit{
+		RateLimitConfig: config,
+		dialer: dialer,
+		limit: config.limitConfig.New(),
+	}, nil
+}
+
+func (r *RateLimit) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := r.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.NewConn(conn, r.limit), nil
+}
+
+func (r *RateLimit) Close() error {
+	if closer, ok := r.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	Register("ratelimit", &RateLimitConfig{})
+}
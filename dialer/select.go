@@ -0,0 +1,160 @@
+package dialer
+
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	selectLock = sync.RWMutex{}
+	selectors = map[string]*Select{}
+)
+
+type SelectConfig struct {
+	Tag string `subsurface:"tag" description:"name used to switch the dialer from the admin API"`
+	Selected string `subsurface:"selected" description:"dialer used at start"`
+	Dialers map[string]interface{} `subsurface:"dialers" schema:"values:dialer" description:"dialers to select from, by name"`
+	dialerConfigs map[string]Config
+}
+
+type Select struct {
+	*SelectConfig
+	dialers map[string]Dialer
+	selected atomic.Value
+}
+
+func (config *SelectConfig) Init() error {
+	if config.Tag == "" {
+		return errors.New("select tag not found")
+	}
+	if len(config.Dialers) == 0 {
+		return errors.New("select dialers not found")
+	}
+	config.dialerConfigs = make(map[string]Config, len(config.Dialers))
+	for name, d := range config.Dialers {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			return errors.New("dialer " + name + " config type error")
+		}
+		dialerConfig, err := GetDialerConfig(m)
+		if err == nil {
+			err = dialerConfig.Init()
+		}
+		if err != nil {
+			return parser.Prefix("dialers."+name, err)
+		}
+		config.dialerConfigs[name] = dialerConfig
+	}
+	if config.Selected == "" {
+		names := make([]string, 0, len(config.dialerConfigs))
+		for name := range config.dialerConfigs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		config.Selected = names[0]
+	} else if _, ok := config.dialerConfigs[config.Selected]; !ok {
+		return errors.New("selected dialer " + config.Selected + " not found")
+	}
+	return nil
+}
+
+func (config *SelectConfig) Clone() Config {
+	return &SelectConfig{
+		Tag: config.Tag,
+		Selected: config.Selected,
+		Dialers: config.Dialers,
+		dialerConfigs: config.dialerConfigs,
+	}
+}
+
+func (config *SelectConfig) New() (Dialer, error) {
+	s := &Select{
+		SelectConfig: config,
+		dialers: make(map[string]Dialer, len(config.dialerConfigs)),
+	}
+	for name, dialerConfig := range config.dialerConfigs {
+		dialer, err := dialerConfig.New()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.dialers[name] = dialer
+	}
+	s.selected.Store(config.Selected)
+	selectLock.Lock()
+	selectors[config.Tag] = s
+	selectLock.Unlock()
+	return s, nil
+}
+
+func (s *Select) Current() string {
+	return s.selected.Load().(string)
+}
+
+func (s *Select) Options() []string {
+	names := make([]string, 0, len(s.dialers))
+	for name := range s.dialers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Select) Switch(name string) error {
+	if _, ok := s.dialers[name]; !ok {
+		return errors.New("dialer " + name + " not found in select " + s.Tag)
+	}
+	s.selected.Store(name)
+	return nil
+}
+
+func (s *Select) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return s.dialers[s.Current()].DialContext(ctx, network, address)
+}
+
+func (s *Select) Close() error {
+	selectLock.Lock()
+	if selectors[s.Tag] == s {
+		delete(selectors, s.Tag)
+	}
+	selectLock.Unlock()
+	var err error
+	for _, dialer := range s.dialers {
+		if closer, ok := dialer.(io.Closer); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func GetSelect(tag string) (*Select, bool) {
+	selectLock.RLock()
+	defer selectLock.RUnlock()
+	s, ok := selectors[tag]
+	return s, ok
+}
+
+func Selects() []*Select {
+	selectLock.RLock()
+	defer selectLock.RUnlock()
+	list := make([]*Select, 0, len(selectors))
+	for _, s := range selectors {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Tag < list[j].Tag
+	})
+	return list
+}
+
+func init() {
+	Register("select", &SelectConfig{})
+}
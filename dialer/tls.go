@@ -0,0 +1,116 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/gchange/subsurface-stream/parser"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+type TLSConfig struct {
+	ServerName string `subsurface:"server_name" description:"TLS server name, defaults to the dialed host"`
+	Insecure bool `subsurface:"insecure" description:"skip TLS certificate verification"`
+	CA string `subsurface:"ca" description:"PEM file of trusted CA certificates"`
+	Cert string `subsurface:"cert" description:"PEM client certificate file"`
+	Key string `subsurface:"key" description:"PEM client key file"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer used for the underlying connection"`
+	tlsConfig *tls.Config
+	dialerConfig Config
+}
+
+type TLS struct {
+	*TLSConfig
+	dialer Dialer
+}
+
+func (config *TLSConfig) Init() error {
+	config.tlsConfig = &tls.Config{
+		ServerName: config.ServerName,
+		InsecureSkipVerify: config.Insecure,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.CA != "" {
+		buf, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return errors.New("no certificate found in " + config.CA)
+		}
+		config.tlsConfig.RootCAs = pool
+	}
+	if config.Cert != "" || config.Key != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return err
+		}
+		config.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	var err error
+	config.dialerConfig, err = GetDialerConfig(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
+	}
+	return parser.Prefix("dialer", config.dialerConfig.Init())
+}
+
+func (config *TLSConfig) Clone() Config {
+	return &TLSConfig{
+		ServerName: config.ServerName,
+		Insecure: config.Insecure,
+		CA: config.CA,
+		Cert: config.Cert,
+		Key: config.Key,
+		Dialer: config.Dialer,
+		tlsConfig: config.tlsConfig,
+		dialerConfig: config.dialerConfig,
+	}
+}
+
+func (config *TLSConfig) New() (Dialer, error) {
+	dialer, err := config.dialerConfig.New()
+	if err != nil {
+		return nil, err
+	}
+	return &TLS{config, dialer}, nil
+}
+
+func (t *TLS) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := t.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := t.tlsConfig
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (t *TLS) Close() error {
+	if closer, ok := t.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	Register("tls", &TLSConfig{})
+}
@@ -0,0 +1,138 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WebSocketConfig struct {
+	Path string `subsurface:"path" default:"/" description:"request path of the WebSocket upgrade"`
+	Host string `subsurface:"host" description:"Host header of the upgrade request, defaults to the dialed address"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer used for the underlying connection, use a tls dialer for wss"`
+	dialerConfig Config
+}
+
+type WebSocket struct {
+	*WebSocketConfig
+	dialer Dialer
+}
+
+type webSocketConn struct {
+	*websocket.Conn
+	reader io.Reader
+	lock sync.Mutex
+}
+
+func WebSocketConn(conn *websocket.Conn) net.Conn {
+	return &webSocketConn{Conn: conn}
+}
+
+func (conn *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			_, reader, err := conn.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			conn.reader = reader
+		}
+		n, err := conn.reader.Read(b)
+		if err == io.EOF {
+			conn.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (conn *webSocketConn) Write(b []byte) (int, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *webSocketConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+func (config *WebSocketConfig) Init() error {
+	if !strings.HasPrefix(config.Path, "/") {
+		return errors.New("websocket path must start with /")
+	}
+	var err error
+	config.dialerConfig, err = GetDialerConfig(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
+	}
+	return parser.Prefix("dialer", config.dialerConfig.Init())
+}
+
+func (config *WebSocketConfig) Clone() Config {
+	return &WebSocketConfig{
+		Path: config.Path,
+		Host: config.Host,
+		Dialer: config.Dialer,
+		dialerConfig: config.dialerConfig,
+	}
+}
+
+func (config *WebSocketConfig) New() (Dialer, error) {
+	dialer, err := config.dialerConfig.New()
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocket{config, dialer}, nil
+}
+
+func (ws *WebSocket) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host := ws.Host
+	if host == "" {
+		host = address
+	}
+	u := url.URL{Scheme: "ws", Host: host, Path: ws.Path}
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return ws.dialer.DialContext(ctx, network, address)
+		},
+	}
+	conn, resp, err := d.DialContext(ctx, u.String(), http.Header{})
+	if err != nil {
+		if resp != nil {
+			return nil, errors.New("websocket upgrade failed: " + resp.Status)
+		}
+		return nil, err
+	}
+	return WebSocketConn(conn), nil
+}
+
+func (ws *WebSocket) Close() error {
+	if closer, ok := ws.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	Register("websocket", &WebSocketConfig{})
+}
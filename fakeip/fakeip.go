@@ -0,0 +1,167 @@
+package fakeip
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	lock  = sync.RWMutex{}
+	pools = map[*Pool]bool{}
+)
+
+type entry struct {
+	domain string
+	offset uint32
+	refs   int
+}
+
+type Pool struct {
+	network  *net.IPNet
+	first    uint32
+	size     uint32
+	next     uint32
+	byDomain map[string]*list.Element
+	byOffset map[uint32]*list.Element
+	recent   *list.List
+	lock     sync.Mutex
+}
+
+func NewPool(cidr string) (*Pool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := network.IP.To4()
+	if ip == nil {
+		return nil, errors.New("fake ip pool must be an ipv4 network")
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("fake ip pool is too small")
+	}
+	size := uint32(1)<<uint(bits-ones) - 2
+	return &Pool{
+		network:  network,
+		first:    binary.BigEndian.Uint32(ip) + 1,
+		size:     size,
+		byDomain: map[string]*list.Element{},
+		byOffset: map[uint32]*list.Element{},
+		recent:   list.New(),
+	}, nil
+}
+
+func (p *Pool) Contains(ip net.IP) bool {
+	return p.network.Contains(ip)
+}
+
+func (p *Pool) allocate() (uint32, bool) {
+	if p.next < p.size {
+		p.next++
+		return p.next - 1, true
+	}
+	for elem := p.recent.Back(); elem != nil; elem = elem.Prev() {
+		e := elem.Value.(*entry)
+		if e.refs > 0 {
+			continue
+		}
+		p.recent.Remove(elem)
+		delete(p.byDomain, e.domain)
+		delete(p.byOffset, e.offset)
+		return e.offset, true
+	}
+	return 0, false
+}
+
+func (p *Pool) Lookup(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	elem, ok := p.byDomain[domain]
+	if ok {
+		p.recent.MoveToFront(elem)
+	} else {
+		offset, ok := p.allocate()
+		if !ok {
+			return nil
+		}
+		elem = p.recent.PushFront(&entry{domain: domain, offset: offset})
+		p.byDomain[domain] = elem
+		p.byOffset[offset] = elem
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.first+elem.Value.(*entry).offset)
+	return ip
+}
+
+func (p *Pool) find(ip net.IP) (*entry, bool) {
+	ip = ip.To4()
+	if ip == nil || !p.network.Contains(ip) {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(ip)
+	if n < p.first || n-p.first >= p.size {
+		return nil, false
+	}
+	elem, ok := p.byOffset[n-p.first]
+	if !ok {
+		return nil, false
+	}
+	p.recent.MoveToFront(elem)
+	return elem.Value.(*entry), true
+}
+
+func (p *Pool) Domain(ip net.IP) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e, ok := p.find(ip)
+	if !ok {
+		return "", false
+	}
+	return e.domain, true
+}
+
+func (p *Pool) Acquire(ip net.IP) (string, func(), bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e, ok := p.find(ip)
+	if !ok {
+		return "", nil, false
+	}
+	e.refs++
+	once := sync.Once{}
+	return e.domain, func() {
+		once.Do(func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			e.refs--
+		})
+	}, true
+}
+
+func Register(p *Pool) {
+	lock.Lock()
+	defer lock.Unlock()
+	pools[p] = true
+}
+
+func Unregister(p *Pool) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(pools, p)
+}
+
+func Acquire(ip net.IP) (string, func(), bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for p := range pools {
+		if domain, release, ok := p.Acquire(ip); ok {
+			return domain, release, true
+		}
+	}
+	return "", nil, false
+}
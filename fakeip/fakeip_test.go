@@ -0,0 +1,61 @@
+package fakeip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	p, err := NewPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.Lookup("a.example.")
+	b := p.Lookup("b.example")
+	if a.Equal(b) {
+		t.Fatalf("a and b share %s", a)
+	}
+	if got := p.Lookup("A.example"); !got.Equal(a) {
+		t.Fatalf("lookup of a moved from %s to %s", a, got)
+	}
+	c := p.Lookup("c.example")
+	if !c.Equal(b) {
+		t.Fatalf("c got %s, want the least recently used %s", c, b)
+	}
+	if domain, ok := p.Domain(a); !ok || domain != "a.example" {
+		t.Fatalf("got (%q, %v) for %s", domain, ok, a)
+	}
+	if _, ok := p.Domain(b); !ok {
+		t.Fatalf("%s lost its new domain", b)
+	}
+}
+
+func TestPoolKeepsAcquiredAddresses(t *testing.T) {
+	p, err := NewPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.Lookup("a.example")
+	b := p.Lookup("b.example")
+	domain, release, ok := p.Acquire(a)
+	if !ok || domain != "a.example" {
+		t.Fatalf("got (%q, %v) for %s", domain, ok, a)
+	}
+	p.Lookup("b.example")
+	if c := p.Lookup("c.example"); !c.Equal(b) {
+		t.Fatalf("c got %s, want %s", c, b)
+	}
+	_, releaseB, _ := p.Acquire(b)
+	if d := p.Lookup("d.example"); d != nil {
+		t.Fatalf("d got %s while every address is in use", d)
+	}
+	release()
+	release()
+	if d := p.Lookup("d.example"); !d.Equal(a) {
+		t.Fatalf("d got %s, want the released %s", d, a)
+	}
+	releaseB()
+	if _, _, ok := p.Acquire(net.IPv4(198, 18, 0, 3)); ok {
+		t.Fatal("acquired the broadcast address")
+	}
+}
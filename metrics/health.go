@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Upstream struct {
+	Address string    `json:"address"`
+	Up      bool      `json:"up"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type Route struct {
+	Stream   string `json:"stream"`
+	Outbound string `json:"outbound"`
+	Rule     string `json:"rule"`
+	Count    uint64 `json:"count"`
+}
+
+var (
+	upstreams    = map[string]*Upstream{}
+	upstreamLock = sync.RWMutex{}
+)
+
+func SetUpstream(address string, err error) {
+	upstream := &Upstream{
+		Address: address,
+		Up:      err == nil,
+		Checked: time.Now(),
+	}
+	if err != nil {
+		upstream.Error = err.Error()
+		UpstreamUp.WithLabelValues(address).Set(0)
+	} else {
+		UpstreamUp.WithLabelValues(address).Set(1)
+	}
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	upstreams[address] = upstream
+}
+
+func Upstreams() []Upstream {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	list := make([]Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		list = append(list, *upstream)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+func RouteStats() ([]Route, error) {
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]Route, 0)
+	for _, family := range families {
+		if family.GetName() != namespace+"_route_decisions_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			route := Route{Count: uint64(metric.GetCounter().GetValue())}
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "stream":
+					route.Stream = label.GetValue()
+				case "outbound":
+					route.Outbound = label.GetValue()
+				case "rule":
+					route.Rule = label.GetValue()
+				}
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+const namespace = "subsurface"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	Accepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accepted_connections_total",
+		Help:      "Connections accepted per listener.",
+	}, []string{"listener"})
+	Rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_connections_total",
+		Help:      "Connections rejected per listener and reason.",
+	}, []string{"listener", "reason"})
+	ActiveTunnels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_tunnels",
+		Help:      "Tunnels currently relaying traffic.",
+	}, []string{"stream", "outbound"})
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Bytes relayed per stream, outbound and direction.",
+	}, []string{"stream", "outbound", "direction"})
+	DialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dial_duration_seconds",
+		Help:      "Outbound dial latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"dialer", "network"})
+	DialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_errors_total",
+		Help:      "Outbound dial failures by reason.",
+	}, []string{"dialer", "reason"})
+	Routes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route_decisions_total",
+		Help:      "Routing decisions by outbound and rule.",
+	}, []string{"stream", "outbound", "rule"})
+	UpstreamUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_up",
+		Help:      "Whether the last dial to an upstream proxy succeeded.",
+	}, []string{"upstream"})
+)
+
+type Config struct {
+	Address string `json:"address" validate:"address" description:"listen address of the metrics server"`
+	Path    string `json:"path" description:"HTTP path of the metrics"`
+}
+
+type Metrics struct {
+	*Config
+	listener net.Listener
+	server   *http.Server
+}
+
+func (config *Config) New() (*Metrics, error) {
+	if config.Path == "" {
+		config.Path = "/metrics"
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return &Metrics{
+		Config:   config,
+		listener: listener,
+		server:   &http.Server{Handler: mux},
+	}, nil
+}
+
+func (m *Metrics) Run() {
+	err := m.server.Serve(m.listener)
+	if err != nil && err != http.ErrServerClosed {
+		logrus.WithError(err).Error("metrics server stopped")
+	}
+}
+
+func (m *Metrics) Close() error {
+	return m.server.Shutdown(context.Background())
+}
+
+func Reason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return "timeout"
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	}
+	return "other"
+}
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		Accepted,
+		Rejected,
+		ActiveTunnels,
+		Bytes,
+		DialDuration,
+		DialErrors,
+		Routes,
+		UpstreamUp,
+	)
+}
@@ -0,0 +1,88 @@
+package nameserver
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	msg    *dns.Msg
+	expire time.Time
+}
+
+type cache struct {
+	size    int
+	entries map[dns.Question]cacheEntry
+	lock    sync.Mutex
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[dns.Question]cacheEntry, size),
+	}
+}
+
+func cacheKey(q dns.Question) dns.Question {
+	q.Name = dns.CanonicalName(q.Name)
+	return q
+}
+
+func (c *cache) get(q dns.Question) *dns.Msg {
+	if c.size <= 0 {
+		return nil
+	}
+	c.lock.Lock()
+	entry, ok := c.entries[cacheKey(q)]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	ttl := time.Until(entry.expire)
+	if ttl <= 0 {
+		return nil
+	}
+	msg := entry.msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = uint32(ttl / time.Second)
+			}
+		}
+	}
+	return msg
+}
+
+func (c *cache) set(q dns.Question, msg *dns.Msg) {
+	if c.size <= 0 || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) == 0 {
+		return
+	}
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if entry.expire.Before(now) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[cacheKey(q)] = cacheEntry{msg.Copy(), time.Now().Add(time.Duration(ttl) * time.Second)}
+}
@@ -0,0 +1,258 @@
+package nameserver
+
+import (
+	"errors"
+	"github.com/gchange/subsurface-stream/fakeip"
+	"github.com/gchange/subsurface-stream/resolver"
+	"github.com/gchange/subsurface-stream/steam"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Network string         `json:"network" validate:"oneof=udp tcp" description:"listen network, both udp and tcp when empty"`
+	Address string         `json:"address" validate:"address" description:"listen address"`
+	Hosts   string         `json:"hosts" description:"hosts file answered locally"`
+	Cache   int            `json:"cache" description:"maximum cached answers"`
+	Domains string         `json:"domains" description:"domain rule CSV file"`
+	Default string         `json:"default" validate:"oneof=direct proxy" description:"upstream for names without a rule"`
+	Timeout time.Duration  `json:"timeout" default:"5s" description:"upstream query timeout"`
+	FakeIP  string         `json:"fake_ip" validate:"cidr" description:"range for fake IP answers of proxied names"`
+	Direct  UpstreamConfig `json:"direct" description:"upstream for direct names"`
+	Proxy   UpstreamConfig `json:"proxy" description:"upstream for proxied names"`
+}
+
+type Nameserver struct {
+	*Config
+	hosts   map[string][]net.IP
+	domains stream.DomainList
+	cache   *cache
+	direct  *upstream
+	proxy   *upstream
+	fakeIP  *fakeip.Pool
+	servers []*dns.Server
+}
+
+func (config *Config) Build() (*Nameserver, error) {
+	ns := &Nameserver{
+		Config:  config,
+		hosts:   map[string][]net.IP{},
+		domains: stream.DomainList{},
+		cache:   newCache(config.Cache),
+	}
+	var err error
+	if config.Hosts != "" {
+		err = resolver.LoadHosts(config.Hosts, ns.hosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Domains != "" {
+		ns.domains, err = stream.LoadDomainList(config.Domains)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch config.Default {
+	case "":
+		config.Default = "direct"
+	case "direct", "proxy":
+	default:
+		return nil, errors.New("unsupported default outbound " + config.Default)
+	}
+	ns.direct, err = config.Direct.New()
+	if err != nil {
+		return nil, err
+	}
+	if config.Proxy.Address != "" {
+		if config.Proxy.Network == "" {
+			config.Proxy.Network = "tcp"
+		}
+		ns.proxy, err = config.Proxy.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.FakeIP != "" {
+		ns.fakeIP, err = fakeip.NewPool(config.FakeIP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ns, nil
+}
+
+func (config *Config) New() (*Nameserver, error) {
+	ns, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+	networks := []string{"udp", "tcp"}
+	if config.Network != "" {
+		networks = []string{config.Network}
+	}
+	for _, network := range networks {
+		server := &dns.Server{Net: network, Handler: ns}
+		switch network {
+		case "udp":
+			server.PacketConn, err = net.ListenPacket(network, config.Address)
+		case "tcp":
+			server.Listener, err = net.Listen(network, config.Address)
+		default:
+			err = errors.New("unsupported network " + network)
+		}
+		if err != nil {
+			ns.Close()
+			return nil, err
+		}
+		ns.servers = append(ns.servers, server)
+	}
+	return ns, nil
+}
+
+func (ns *Nameserver) Run() {
+	if ns.fakeIP != nil {
+		fakeip.Register(ns.fakeIP)
+	}
+	for _, server := range ns.servers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				logrus.WithError(err).WithField("network", server.Net).Debug("nameserver stopped")
+			}
+		}(server)
+	}
+}
+
+func (ns *Nameserver) Close() error {
+	if ns.fakeIP != nil {
+		fakeip.Unregister(ns.fakeIP)
+	}
+	var err error
+	for _, server := range ns.servers {
+		if server.PacketConn != nil {
+			if e := server.PacketConn.Close(); e != nil {
+				err = e
+			}
+		}
+		if server.Listener != nil {
+			if e := server.Listener.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (ns *Nameserver) lookupHosts(q dns.Question) []dns.RR {
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	ips, ok := ns.hosts[strings.ToLower(strings.TrimSuffix(q.Name, "."))]
+	if !ok {
+		return nil
+	}
+	answer := make([]dns.RR, 0, len(ips))
+	header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			answer = append(answer, &dns.A{Hdr: header, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			answer = append(answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return answer
+}
+
+func (ns *Nameserver) lookupFakeIP(r *dns.Msg, outbound string) *dns.Msg {
+	q := r.Question[0]
+	if ns.fakeIP == nil || outbound == "direct" || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	reply := &dns.Msg{}
+	reply.SetReply(r)
+	if q.Qtype == dns.TypeA {
+		ip := ns.fakeIP.Lookup(q.Name)
+		if ip == nil {
+			logrus.WithField("domain", q.Name).Warn("fake ip pool exhausted")
+			return nil
+		}
+		header := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}
+		reply.Answer = []dns.RR{&dns.A{Hdr: header, A: ip}}
+	}
+	return reply
+}
+
+func (ns *Nameserver) Route(name string) (string, string) {
+	if rule, ok := ns.domains.Match(strings.TrimSuffix(name, ".")); ok {
+		return rule.Action, "domain:" + rule.Suffix
+	}
+	return ns.Default, "default"
+}
+
+func (ns *Nameserver) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return nil, errors.New("unsupported question count")
+	}
+	q := r.Question[0]
+	if answer := ns.lookupHosts(q); len(answer) > 0 {
+		reply := &dns.Msg{}
+		reply.SetReply(r)
+		reply.Authoritative = true
+		reply.Answer = answer
+		return reply, nil
+	}
+	if reply := ns.cache.get(q); reply != nil {
+		reply.Id = r.Id
+		reply.Question = r.Question
+		return reply, nil
+	}
+
+	outbound, rule := ns.Route(q.Name)
+	if reply := ns.lookupFakeIP(r, outbound); reply != nil {
+		return reply, nil
+	}
+	u := ns.direct
+	if outbound == "proxy" && ns.proxy != nil {
+		u = ns.proxy
+	}
+	fields := logrus.Fields{
+		"name":     q.Name,
+		"type":     dns.TypeToString[q.Qtype],
+		"outbound": outbound,
+		"rule":     rule,
+	}
+	reply, err := u.exchange(r, ns.Timeout)
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Debug("nameserver forward failed")
+		return nil, err
+	}
+	logrus.WithFields(fields).Debug("nameserver forward")
+	ns.cache.set(q, reply)
+	return reply, nil
+}
+
+func (ns *Nameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	reply, err := ns.Exchange(r)
+	if err != nil {
+		reply = &dns.Msg{}
+		reply.SetRcode(r, dns.RcodeServerFailure)
+	}
+	if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		reply.Truncate(size)
+	}
+	if err := w.WriteMsg(reply); err != nil {
+		logrus.WithError(err).Debug("nameserver write failed")
+	}
+}
@@ -0,0 +1,66 @@
+package nameserver
+
+import (
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/miekg/dns"
+	"time"
+)
+
+type UpstreamConfig struct {
+	Network string                 `json:"network" validate:"oneof=udp tcp" description:"upstream network"`
+	Address string                 `json:"address" validate:"address" description:"upstream address"`
+	Dialer  map[string]interface{} `json:"dialer" schema:"dialer" description:"dialer used to reach the upstream"`
+}
+
+type upstream struct {
+	*UpstreamConfig
+	dialer dialer.Dialer
+}
+
+func (config *UpstreamConfig) New() (*upstream, error) {
+	if config.Address == "" {
+		return nil, errors.New("upstream address not found")
+	}
+	if config.Network == "" {
+		config.Network = "udp"
+	}
+	if config.Dialer == nil {
+		config.Dialer = map[string]interface{}{"name": "direct"}
+	}
+	d, err := dialer.New(config.Dialer)
+	if err != nil {
+		return nil, parser.Prefix("dialer", err)
+	}
+	return &upstream{config, d}, nil
+}
+
+func (u *upstream) exchange(msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := u.dialer.DialContext(ctx, u.Network, u.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	dc := &dns.Conn{Conn: conn, UDPSize: dns.MaxMsgSize}
+	err = dc.WriteMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := dc.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if reply.Id == msg.Id {
+			return reply, nil
+		}
+	}
+}
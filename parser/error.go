@@ -0,0 +1,77 @@
+package parser
+
+import "strings"
+
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func join(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	if child == "" || strings.HasPrefix(child, "[") {
+		return parent + child
+	}
+	return parent + "." + child
+}
+
+func Prefix(path string, err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return &Error{join(path, e.Path), e.Err}
+	case Errors:
+		errs := make(Errors, len(e))
+		for i, err := range e {
+			errs[i] = Prefix(path, err)
+		}
+		return errs
+	default:
+		return &Error{path, err}
+	}
+}
+
+type Errors []error
+
+func (errs *Errors) Add(err error) {
+	switch e := err.(type) {
+	case nil:
+	case Errors:
+		*errs = append(*errs, e...)
+	default:
+		*errs = append(*errs, err)
+	}
+}
+
+func (errs Errors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs Errors) Err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
@@ -0,0 +1,91 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type kind struct {
+	tagName   string
+	prototype func(name string) (interface{}, bool)
+}
+
+type unknownKey string
+
+var (
+	kindLock = sync.RWMutex{}
+	kinds    = map[string]kind{}
+)
+
+func (match unknownKey) Error() string {
+	if match == "" {
+		return "unknown key"
+	}
+	return "unknown key, did you mean \"" + string(match) + "\"?"
+}
+
+func RegisterKind(name string, tagName string, prototype func(name string) (interface{}, bool)) {
+	kindLock.Lock()
+	defer kindLock.Unlock()
+	kinds[name] = kind{tagName, prototype}
+}
+
+func unknownKeys(err error) Errors {
+	var errs Errors
+	switch e := err.(type) {
+	case Errors:
+		for _, err := range e {
+			errs = append(errs, unknownKeys(err)...)
+		}
+	case nil:
+	default:
+		var match unknownKey
+		if errors.As(err, &match) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func checkKind(path string, schema string, data interface{}) Errors {
+	values := strings.HasPrefix(schema, "values:")
+	kindLock.RLock()
+	k, ok := kinds[strings.TrimPrefix(schema, "values:")]
+	kindLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var errs Errors
+	check := func(path string, item interface{}) {
+		m, ok := toMap(item)
+		if !ok {
+			return
+		}
+		name, _ := m["name"].(string)
+		config, ok := k.prototype(name)
+		if !ok {
+			return
+		}
+		dec := &decoder{tagName: k.tagName, strict: true}
+		errs = append(errs, unknownKeys(dec.unmarshal(path, reflect.ValueOf(config), m, "name"))...)
+	}
+	if values {
+		m, _ := toMap(data)
+		for _, key := range sortedKeys(m) {
+			check(join(path, key), m[key])
+		}
+		return errs
+	}
+	if list, ok := data.([]interface{}); ok {
+		for i, item := range list {
+			check(path+"["+strconv.Itoa(i)+"]", item)
+		}
+		return errs
+	}
+	check(path, data)
+	return errs
+}
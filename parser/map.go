@@ -2,18 +2,48 @@ package parser
 
 import (
 	"errors"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+var durationType = reflect.TypeOf(time.Duration(0))
+
+type decoder struct {
+	tagName string
+	strict  bool
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func integer(f float64, min, max float64) error {
+	if f != math.Trunc(f) {
+		return errors.New("value " + formatFloat(f) + " is not an integer")
+	}
+	if f < min || f >= max {
+		return errors.New("value " + formatFloat(f) + " out of range")
+	}
+	return nil
+}
+
 func parseInt64(val reflect.Value) (int64, error) {
 	switch val.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return val.Int(), nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt64 {
+			return 0, errors.New("value " + strconv.FormatUint(val.Uint(), 10) + " out of range")
+		}
 		return int64(val.Uint()), nil
 	case reflect.Float32, reflect.Float64:
+		if err := integer(val.Float(), math.MinInt64, math.MaxInt64); err != nil {
+			return 0, err
+		}
 		return int64(val.Float()), nil
 	case reflect.String:
 		return strconv.ParseInt(val.String(), 10, 64)
@@ -24,17 +54,26 @@ func parseInt64(val reflect.Value) (int64, error) {
 			return 0, nil
 		}
 	default:
-		return 0, errors.New("syntax error")
+		return 0, errors.New("can not convert " + val.Kind().String() + " to a number")
 	}
 }
 
 func parseUint64(val reflect.Value) (uint64, error) {
 	switch val.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if val.Int() < 0 {
+			return 0, errors.New("value " + strconv.FormatInt(val.Int(), 10) + " must not be negative")
+		}
 		return uint64(val.Int()), nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return val.Uint(), nil
 	case reflect.Float32, reflect.Float64:
+		if val.Float() < 0 {
+			return 0, errors.New("value " + formatFloat(val.Float()) + " must not be negative")
+		}
+		if err := integer(val.Float(), 0, math.MaxUint64); err != nil {
+			return 0, err
+		}
 		return uint64(val.Float()), nil
 	case reflect.String:
 		return strconv.ParseUint(val.String(), 10, 64)
@@ -45,7 +84,7 @@ func parseUint64(val reflect.Value) (uint64, error) {
 			return 0, nil
 		}
 	default:
-		return 0, errors.New("syntax error")
+		return 0, errors.New("can not convert " + val.Kind().String() + " to a number")
 	}
 }
 
@@ -66,7 +105,7 @@ func parseFloat64(val reflect.Value) (float64, error) {
 			return 0, nil
 		}
 	default:
-		return 0, errors.New("syntax error")
+		return 0, errors.New("can not convert " + val.Kind().String() + " to a number")
 	}
 }
 
@@ -77,7 +116,7 @@ func parseString(val reflect.Value) (string, error) {
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return strconv.FormatUint(val.Uint(), 10), nil
 	case reflect.Float32, reflect.Float64:
-		return strconv.FormatFloat(val.Float(), 'f', 6, 64), nil
+		return strconv.FormatFloat(val.Float(), 'f', -1, 64), nil
 	case reflect.String:
 		return val.String(), nil
 	case reflect.Bool:
@@ -87,7 +126,7 @@ func parseString(val reflect.Value) (string, error) {
 			return "false", nil
 		}
 	default:
-		return "", errors.New("syntax error")
+		return "", errors.New("can not convert " + val.Kind().String() + " to a string")
 	}
 }
 
@@ -100,16 +139,54 @@ func parseBool(val reflect.Value) (bool, error) {
 	case reflect.Float32, reflect.Float64:
 		return val.Float() > 0, nil
 	case reflect.String:
-		return val.String() == "", nil
+		if val.String() == "" {
+			return false, nil
+		}
+		return strconv.ParseBool(val.String())
 	case reflect.Bool:
 		return val.Bool(), nil
 	default:
-		return false, errors.New("syntax error")
+		return false, errors.New("can not convert " + val.Kind().String() + " to a bool")
 	}
 }
 
-func Unmarshal(tagName string, val reflect.Value, data map[string]interface{}) error {
-	val = reflect.Indirect(val)
+func parseDuration(val reflect.Value) (time.Duration, error) {
+	switch val.Kind() {
+	case reflect.String:
+		return time.ParseDuration(val.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		seconds, err := parseFloat64(val)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	default:
+		return 0, errors.New("can not convert " + val.Kind().String() + " to a duration")
+	}
+}
+
+func fieldKey(tagName string, tf reflect.StructField) string {
+	if tagName != "" {
+		if tag := tf.Tag.Get(tagName); tag != "" {
+			return strings.Split(tag, ",")[0]
+		}
+	}
+	return strings.ToLower(tf.Name)
+}
+
+func sortedKeys(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (dec *decoder) decodeFields(path string, val reflect.Value, data map[string]interface{}, known map[string]bool) Errors {
+	var errs Errors
 	typ := val.Type()
 	for i := 0; i < val.NumField(); i++ {
 		tf := typ.Field(i)
@@ -117,64 +194,212 @@ func Unmarshal(tagName string, val reflect.Value, data map[string]interface{}) e
 		if !vf.CanSet() {
 			continue
 		}
-
-		key := ""
-		if tag := tf.Tag.Get(tagName); tagName != "" && tag != "" {
-			key = tag
-		} else {
-			key = strings.ToLower(typ.Name())
+		key := fieldKey(dec.tagName, tf)
+		if key == "-" {
+			continue
+		}
+		if tf.Anonymous && vf.Kind() == reflect.Struct && tf.Tag.Get(dec.tagName) == "" {
+			errs = append(errs, dec.decodeFields(path, vf, data, known)...)
+			continue
 		}
 
+		known[key] = true
+		fieldPath := join(path, key)
+		required, _ := strconv.ParseBool(tf.Tag.Get("required"))
 		if d, ok := data[key]; ok {
-			m := reflect.ValueOf(d)
-			if m.Kind() == vf.Kind() {
-				vf.Set(m)
+			if kind := tf.Tag.Get("schema"); dec.strict && kind != "" {
+				errs = append(errs, checkKind(fieldPath, kind, d)...)
+			}
+			if err := dec.decode(fieldPath, vf, d); err != nil {
+				errs.Add(err)
+			} else if err := check(tf.Tag.Get("validate"), vf); err != nil {
+				errs.Add(&Error{fieldPath, err})
+			} else if required && vf.IsZero() {
+				errs.Add(&Error{fieldPath, errors.New("required")})
+			}
+			continue
+		}
+		if vf.Kind() == reflect.Struct {
+			if err := dec.unmarshalStruct(fieldPath, vf, map[string]interface{}{}); err != nil {
+				errs.Add(err)
+			}
+			continue
+		}
+		if def, ok := tf.Tag.Lookup("default"); ok && vf.IsZero() {
+			if err := dec.decode(fieldPath, vf, def); err != nil {
+				errs.Add(err)
+			}
+		}
+		if required && vf.IsZero() {
+			errs.Add(&Error{fieldPath, errors.New("required")})
+		}
+	}
+	return errs
+}
+
+func (dec *decoder) unmarshalStruct(path string, val reflect.Value, data map[string]interface{}, ignore ...string) error {
+	known := make(map[string]bool, val.NumField()+len(ignore))
+	for _, key := range ignore {
+		known[key] = true
+	}
+	errs := dec.decodeFields(path, val, data, known)
+	if dec.strict {
+		candidates := make([]string, 0, len(known))
+		for key := range known {
+			candidates = append(candidates, key)
+		}
+		for _, key := range sortedKeys(data) {
+			if known[key] {
 				continue
 			}
+			errs.Add(&Error{join(path, key), unknownKey(Suggest(key, candidates))})
+		}
+	}
+	return errs.Err()
+}
 
-			switch vf.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				mv, err := parseInt64(m)
-				if err != nil {
-					return err
-				}
-				vf.SetInt(mv)
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				mv, err := parseUint64(m)
-				if err != nil {
-					return err
-				}
-				vf.SetUint(mv)
-			case reflect.Float32, reflect.Float64:
-				mv, err := parseFloat64(m)
-				if err != nil {
-					return err
-				}
-				vf.SetFloat(mv)
-			case reflect.String:
-				mv, err := parseString(m)
-				if err != nil {
-					return err
-				}
-				vf.SetString(mv)
-			case reflect.Bool:
-				mv, err := parseBool(m)
-				if err != nil {
-					return err
-				}
-				vf.SetBool(mv)
-			case reflect.Struct:
-				d, ok := d.(map[string]interface{})
-				if ok {
-					if err := Unmarshal(tagName, val, d); err != nil {
-						return err
-					}
-				}
-			default:
-				return errors.New("wrong type config")
+func toMap(data interface{}) (map[string]interface{}, bool) {
+	switch m := data.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		n := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, false
 			}
+			n[key] = v
+		}
+		return n, true
+	default:
+		return nil, false
+	}
+}
+
+func (dec *decoder) decode(path string, vf reflect.Value, d interface{}) error {
+	if d == nil {
+		vf.Set(reflect.Zero(vf.Type()))
+		return nil
+	}
+	m := reflect.ValueOf(d)
+	if vf.Type() == durationType {
+		mv, err := parseDuration(m)
+		if err != nil {
+			return &Error{path, err}
 		}
+		vf.SetInt(int64(mv))
+		return nil
+	}
+	if m.Type().AssignableTo(vf.Type()) {
+		vf.Set(m)
+		return nil
+	}
+
+	var err error
+	switch vf.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var mv int64
+		if mv, err = parseInt64(m); err == nil {
+			if vf.OverflowInt(mv) {
+				return &Error{path, errors.New("value " + strconv.FormatInt(mv, 10) + " out of range")}
+			}
+			vf.SetInt(mv)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var mv uint64
+		if mv, err = parseUint64(m); err == nil {
+			if vf.OverflowUint(mv) {
+				return &Error{path, errors.New("value " + strconv.FormatUint(mv, 10) + " out of range")}
+			}
+			vf.SetUint(mv)
+		}
+	case reflect.Float32, reflect.Float64:
+		var mv float64
+		if mv, err = parseFloat64(m); err == nil {
+			vf.SetFloat(mv)
+		}
+	case reflect.String:
+		var mv string
+		if mv, err = parseString(m); err == nil {
+			vf.SetString(mv)
+		}
+	case reflect.Bool:
+		var mv bool
+		if mv, err = parseBool(m); err == nil {
+			vf.SetBool(mv)
+		}
+	case reflect.Ptr:
+		if vf.IsNil() {
+			vf.Set(reflect.New(vf.Type().Elem()))
+		}
+		return dec.decode(path, vf.Elem(), d)
+	case reflect.Struct:
+		data, ok := toMap(d)
+		if !ok {
+			return &Error{path, errors.New("expected an object, got " + m.Kind().String())}
+		}
+		return dec.unmarshalStruct(path, vf, data)
+	case reflect.Slice:
+		if m.Kind() != reflect.Slice && m.Kind() != reflect.Array {
+			return &Error{path, errors.New("expected a list, got " + m.Kind().String())}
+		}
+		var errs Errors
+		list := reflect.MakeSlice(vf.Type(), m.Len(), m.Len())
+		for i := 0; i < m.Len(); i++ {
+			err := dec.decode(path+"["+strconv.Itoa(i)+"]", list.Index(i), m.Index(i).Interface())
+			if err != nil {
+				errs.Add(err)
+			}
+		}
+		vf.Set(list)
+		return errs.Err()
+	case reflect.Map:
+		if vf.Type().Key().Kind() != reflect.String {
+			return &Error{path, errors.New("unsupported map key type " + vf.Type().Key().String())}
+		}
+		data, ok := toMap(d)
+		if !ok {
+			return &Error{path, errors.New("expected an object, got " + m.Kind().String())}
+		}
+		var errs Errors
+		mv := reflect.MakeMapWithSize(vf.Type(), len(data))
+		for _, k := range sortedKeys(data) {
+			item := reflect.New(vf.Type().Elem()).Elem()
+			if err := dec.decode(join(path, k), item, data[k]); err != nil {
+				errs.Add(err)
+				continue
+			}
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(vf.Type().Key()), item)
+		}
+		vf.Set(mv)
+		return errs.Err()
+	case reflect.Interface:
+		if !m.Type().Implements(vf.Type()) {
+			return &Error{path, errors.New("can not use " + m.Type().String() + " as " + vf.Type().String())}
+		}
+		vf.Set(m)
+	default:
+		return &Error{path, errors.New("unsupported type " + vf.Type().String())}
+	}
+	if err != nil {
+		return &Error{path, err}
 	}
 	return nil
 }
 
+func (dec *decoder) unmarshal(path string, val reflect.Value, data map[string]interface{}, ignore ...string) error {
+	val = reflect.Indirect(val)
+	if val.Kind() != reflect.Struct {
+		return errors.New("config must be a struct, got " + val.Kind().String())
+	}
+	return dec.unmarshalStruct(path, val, data, ignore...)
+}
+
+func Unmarshal(tagName string, val reflect.Value, data map[string]interface{}, ignore ...string) error {
+	return (&decoder{tagName: tagName}).unmarshal("", val, data, ignore...)
+}
+
+func UnmarshalStrict(tagName string, val reflect.Value, data map[string]interface{}, ignore ...string) error {
+	return (&decoder{tagName: tagName, strict: true}).unmarshal("", val, data, ignore...)
+}
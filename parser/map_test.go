@@ -0,0 +1,233 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testItem struct {
+	Name string `test:"name" required:"true"`
+	Port uint16 `test:"port"`
+}
+
+type testNested struct {
+	Level string `test:"level" default:"info"`
+}
+
+type testConfig struct {
+	Untagged string
+	Enabled  bool                `test:"enabled"`
+	Count    int8                `test:"count"`
+	Size     uint                `test:"size"`
+	Ratio    float64             `test:"ratio"`
+	Timeout  time.Duration       `test:"timeout" default:"5s"`
+	Nested   testNested          `test:"nested"`
+	Pointer  *testNested         `test:"pointer"`
+	Items    []testItem          `test:"items"`
+	Named    map[string]testItem `test:"named"`
+	Tags     []string            `test:"tags"`
+	Mode     string              `test:"mode" validate:"oneof=fast slow"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  map[string]interface{}
+		check func(*testConfig) bool
+		err   string
+	}{
+		{
+			name:  "untagged field uses the field name",
+			data:  map[string]interface{}{"untagged": "value"},
+			check: func(c *testConfig) bool { return c.Untagged == "value" },
+		},
+		{
+			name:  "empty string bool is false",
+			data:  map[string]interface{}{"enabled": ""},
+			check: func(c *testConfig) bool { return !c.Enabled },
+		},
+		{
+			name: "invalid bool",
+			data: map[string]interface{}{"enabled": "maybe"},
+			err:  `enabled: strconv.ParseBool: parsing "maybe": invalid syntax`,
+		},
+		{
+			name:  "nested struct decodes into the field",
+			data:  map[string]interface{}{"nested": map[string]interface{}{"level": "debug"}},
+			check: func(c *testConfig) bool { return c.Nested.Level == "debug" },
+		},
+		{
+			name:  "defaults apply to missing keys and nested structs",
+			data:  map[string]interface{}{},
+			check: func(c *testConfig) bool { return c.Timeout == 5*time.Second && c.Nested.Level == "info" },
+		},
+		{
+			name:  "pointer to struct",
+			data:  map[string]interface{}{"pointer": map[string]interface{}{"level": "warn"}},
+			check: func(c *testConfig) bool { return c.Pointer != nil && c.Pointer.Level == "warn" },
+		},
+		{
+			name:  "duration string",
+			data:  map[string]interface{}{"timeout": "1m30s"},
+			check: func(c *testConfig) bool { return c.Timeout == 90*time.Second },
+		},
+		{
+			name:  "duration seconds",
+			data:  map[string]interface{}{"timeout": 1.5},
+			check: func(c *testConfig) bool { return c.Timeout == 1500*time.Millisecond },
+		},
+		{
+			name: "slice of structs",
+			data: map[string]interface{}{"items": []interface{}{
+				map[string]interface{}{"name": "a", "port": 80},
+				map[string]interface{}{"name": "b", "port": "443"},
+			}},
+			check: func(c *testConfig) bool {
+				return reflect.DeepEqual(c.Items, []testItem{{"a", 80}, {"b", 443}})
+			},
+		},
+		{
+			name: "map of structs",
+			data: map[string]interface{}{"named": map[string]interface{}{
+				"x": map[string]interface{}{"name": "x"},
+			}},
+			check: func(c *testConfig) bool { return c.Named["x"].Name == "x" },
+		},
+		{
+			name:  "slice of strings",
+			data:  map[string]interface{}{"tags": []interface{}{"a", 1}},
+			check: func(c *testConfig) bool { return reflect.DeepEqual(c.Tags, []string{"a", "1"}) },
+		},
+		{
+			name: "required field reports its path",
+			data: map[string]interface{}{"items": []interface{}{map[string]interface{}{"port": 1}}},
+			err:  "items[0].name: required",
+		},
+		{
+			name: "required field must not be empty",
+			data: map[string]interface{}{"items": []interface{}{map[string]interface{}{"name": ""}}},
+			err:  "items[0].name: required",
+		},
+		{
+			name:  "float to string keeps its precision",
+			data:  map[string]interface{}{"tags": []interface{}{0.1, 1.0, 1e-7, 123456789.123}},
+			check: func(c *testConfig) bool { return reflect.DeepEqual(c.Tags, []string{"0.1", "1", "0.0000001", "123456789.123"}) },
+		},
+		{
+			name: "error path through a map",
+			data: map[string]interface{}{"named": map[string]interface{}{
+				"x": map[string]interface{}{"name": "x", "port": "http"},
+			}},
+			err: `named.x.port: strconv.ParseUint: parsing "http": invalid syntax`,
+		},
+		{
+			name: "int overflow",
+			data: map[string]interface{}{"count": 300},
+			err:  "count: value 300 out of range",
+		},
+		{
+			name: "uint overflow",
+			data: map[string]interface{}{"items": []interface{}{map[string]interface{}{"name": "a", "port": 70000}}},
+			err:  "items[0].port: value 70000 out of range",
+		},
+		{
+			name: "negative int for an unsigned field",
+			data: map[string]interface{}{"size": -1},
+			err:  "size: value -1 must not be negative",
+		},
+		{
+			name: "negative float for an unsigned field",
+			data: map[string]interface{}{"size": -1.0},
+			err:  "size: value -1 must not be negative",
+		},
+		{
+			name: "fraction for an integer field",
+			data: map[string]interface{}{"count": 1.5},
+			err:  "count: value 1.5 is not an integer",
+		},
+		{
+			name: "fraction for an unsigned field",
+			data: map[string]interface{}{"size": 2.5},
+			err:  "size: value 2.5 is not an integer",
+		},
+		{
+			name:  "whole float for an integer field",
+			data:  map[string]interface{}{"count": 12.0, "size": 7.0},
+			check: func(c *testConfig) bool { return c.Count == 12 && c.Size == 7 },
+		},
+		{
+			name:  "float field",
+			data:  map[string]interface{}{"ratio": "0.25"},
+			check: func(c *testConfig) bool { return c.Ratio == 0.25 },
+		},
+		{
+			name: "validate rule",
+			data: map[string]interface{}{"mode": "medium"},
+			err:  `mode: unsupported value "medium"`,
+		},
+		{
+			name: "list expected",
+			data: map[string]interface{}{"items": "a"},
+			err:  "items: expected a list, got string",
+		},
+		{
+			name: "object expected",
+			data: map[string]interface{}{"nested": 1},
+			err:  "nested: expected an object, got int",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := &testConfig{}
+			err := Unmarshal("test", reflect.ValueOf(config), c.data)
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.check(config) {
+				t.Fatalf("unexpected result %+v", config)
+			}
+		})
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	err := UnmarshalStrict("test", reflect.ValueOf(&testConfig{}), map[string]interface{}{
+		"timeot": "1s",
+		"nested": map[string]interface{}{"levle": "debug"},
+	})
+	want := `nested.levle: unknown key, did you mean "level"?` + "\n" + `timeot: unknown key, did you mean "timeout"?`
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
+
+func TestUnmarshalStrictKinds(t *testing.T) {
+	RegisterKind("test", "test", func(name string) (interface{}, bool) {
+		return &testConfig{}, name == "nested"
+	})
+	type kindConfig struct {
+		One  map[string]interface{}            `test:"one" schema:"test"`
+		List []map[string]interface{}          `test:"list" schema:"test"`
+		Map  map[string]map[string]interface{} `test:"map" schema:"values:test"`
+	}
+	data := map[string]interface{}{
+		"one":  map[string]interface{}{"name": "nested", "timeot": "1s", "count": "many"},
+		"list": []interface{}{map[string]interface{}{"name": "other", "timeot": "1s"}, map[string]interface{}{"name": "nested", "enabeld": true}},
+		"map":  map[string]interface{}{"a": map[string]interface{}{"name": "nested", "timeout": "1s"}},
+	}
+	if err := Unmarshal("test", reflect.ValueOf(&kindConfig{}), data); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	err := UnmarshalStrict("test", reflect.ValueOf(&kindConfig{}), data)
+	want := `one.timeot: unknown key, did you mean "timeout"?` + "\n" + `list[1].enabeld: unknown key, did you mean "enabled"?`
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
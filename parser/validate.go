@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func checkAddress(s string) error {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.New("invalid port " + port)
+	}
+	return nil
+}
+
+func check(rule string, val reflect.Value) error {
+	if rule == "" || val.Kind() != reflect.String || val.String() == "" {
+		return nil
+	}
+	s := val.String()
+	switch rule {
+	case "address":
+		return checkAddress(s)
+	case "cidr":
+		_, _, err := net.ParseCIDR(s)
+		return err
+	case "ip":
+		if net.ParseIP(s) == nil {
+			return errors.New("invalid ip " + s)
+		}
+	case "url":
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.New("invalid url " + s)
+		}
+	case "duration":
+		_, err := time.ParseDuration(s)
+		return err
+	default:
+		if strings.HasPrefix(rule, "oneof=") {
+			options := strings.Split(strings.TrimPrefix(rule, "oneof="), " ")
+			for _, option := range options {
+				if s == option {
+					return nil
+				}
+			}
+			msg := "unsupported value " + strconv.Quote(s)
+			if match := Suggest(s, options); match != "" {
+				msg += ", did you mean \"" + match + "\"?"
+			}
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func Suggest(name string, candidates []string) string {
+	best, bestDistance := "", len(name)/3+2
+	for _, candidate := range candidates {
+		d := distance(strings.ToLower(name), strings.ToLower(candidate))
+		if d < bestDistance || (d == bestDistance && best != "" && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func UnknownName(kind string, name string, names []string) error {
+	msg := "unknown " + kind + " " + strconv.Quote(name)
+	if match := Suggest(name, names); match != "" {
+		msg += ", did you mean \"" + match + "\"?"
+	}
+	return errors.New(msg)
+}
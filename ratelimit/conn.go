@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type Conn struct {
+	net.Conn
+	limit  *Limit
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewConn(conn net.Conn, limit *Limit) net.Conn {
+	if limit == nil {
+		return conn
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		Conn:   conn,
+		limit:  limit,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	if burst := conn.limit.Download.Burst(); burst > 0 && int64(len(b)) > burst {
+		b = b[:burst]
+	}
+	n, err := conn.Conn.Read(b)
+	if e := conn.limit.Download.WaitN(conn.ctx, int64(n)); e != nil && err == nil {
+		err = e
+	}
+	return n, err
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if burst := conn.limit.Upload.Burst(); burst > 0 && int64(len(chunk)) > burst {
+			chunk = chunk[:burst]
+		}
+		if err := conn.limit.Upload.WaitN(conn.ctx, int64(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := conn.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (conn *Conn) CloseWrite() error {
+	if cw, ok := conn.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
+}
+
+func (conn *Conn) Close() error {
+	conn.cancel()
+	return conn.Conn.Close()
+}
@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+type Limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func NewLimiter(rate, burst int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) Burst() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.burst)
+}
+
+func (l *Limiter) reserve(n int64) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) WaitN(ctx context.Context, n int64) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type Limit struct {
+	Upload   *Limiter
+	Download *Limiter
+}
+
+type Config struct {
+	Upload   int64 `json:"upload" subsurface:"upload" description:"upload limit in bytes per second, 0 is unlimited"`
+	Download int64 `json:"download" subsurface:"download" description:"download limit in bytes per second, 0 is unlimited"`
+	Burst    int64 `json:"burst" subsurface:"burst" description:"bucket size in bytes, defaults to one second of traffic"`
+}
+
+func (config *Config) Init() error {
+	if config.Upload < 0 || config.Download < 0 || config.Burst < 0 {
+		return errors.New("invalid rate limit")
+	}
+	return nil
+}
+
+func (config *Config) New() *Limit {
+	if config == nil || (config.Upload <= 0 && config.Download <= 0) {
+		return nil
+	}
+	return &Limit{
+		Upload:   NewLimiter(config.Upload, config.Burst),
+		Download: NewLimiter(config.Download, config.Burst),
+	}
+}
+
+type GroupConfig struct {
+	Config
+	Tunnel *Config            `json:"tunnel" description:"limits of each tunnel"`
+	Users  map[string]*Config `json:"users" description:"limits by SOCKS5 user"`
+}
+
+type Group struct {
+	*GroupConfig
+	listener *Limit
+	users    map[string]*Limit
+}
+
+func (config *GroupConfig) Init() error {
+	if err := config.Config.Init(); err != nil {
+		return err
+	}
+	if config.Tunnel != nil {
+		if err := config.Tunnel.Init(); err != nil {
+			return err
+		}
+	}
+	for user, c := range config.Users {
+		if c == nil {
+			return errors.New("rate limit of user " + user + " not found")
+		}
+		if err := c.Init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (config *GroupConfig) New() *Group {
+	if config == nil {
+		return nil
+	}
+	group := &Group{
+		GroupConfig: config,
+		listener:    config.Config.New(),
+		users:       make(map[string]*Limit, len(config.Users)),
+	}
+	for user, c := range config.Users {
+		if limit := c.New(); limit != nil {
+			group.users[user] = limit
+		}
+	}
+	return group
+}
+
+func (group *Group) Limits(user string) []*Limit {
+	if group == nil {
+		return nil
+	}
+	limits := make([]*Limit, 0, 3)
+	if group.listener != nil {
+		limits = append(limits, group.listener)
+	}
+	if limit, ok := group.users[user]; ok && user != "" {
+		limits = append(limits, limit)
+	}
+	if limit := group.Tunnel.New(); limit != nil {
+		limits = append(limits, limit)
+	}
+	return limits
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AdminConfig struct {
+	Address string `json:"address" validate:"address" description:"listen address of the admin API"`
+	Token string `json:"token" description:"bearer token required by the admin API"`
+}
+
+type admin struct {
+	*AdminConfig
+	server *server
+	listener net.Listener
+	http *http.Server
+}
+
+type listenerView struct {
+	Key string `json:"key"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Connections int `json:"connections"`
+	Tunnels int `json:"tunnels"`
+	Streams []string `json:"streams"`
+}
+
+type chainView struct {
+	Key string `json:"key"`
+	Config []interface{} `json:"config"`
+}
+
+type tunnelView struct {
+	ID uint64 `json:"id"`
+	Listener string `json:"listener"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Stream string `json:"stream"`
+	Outbound string `json:"outbound"`
+	User string `json:"user,omitempty"`
+	Upload int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Start time.Time `json:"start"`
+}
+
+type outboundView struct {
+	Tag string `json:"tag"`
+	Selected string `json:"selected"`
+	Options []string `json:"options"`
+}
+
+var secretKeys = map[string]bool{
+	"users": true,
+	"password": true,
+	"token": true,
+}
+
+func redact(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			if secretKeys[key] {
+				m[key] = "******"
+			} else {
+				m[key] = redact(item)
+			}
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for i, item := range val {
+			list[i] = redact(item)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+func (config *AdminConfig) Validate() error {
+	if config.Address == "" {
+		return errors.New("admin address not found")
+	}
+	if config.Token == "" {
+		return errors.New("admin token not found")
+	}
+	return nil
+}
+
+func (config *AdminConfig) New(s *server) (*admin, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	a := &admin{
+		AdminConfig: config,
+		server: s,
+		listener: listener,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/listeners", a.method(http.MethodGet, a.listeners))
+	mux.HandleFunc("/listeners/drain", a.method(http.MethodPost, a.drain))
+	mux.HandleFunc("/chains", a.method(http.MethodGet, a.chains))
+	mux.HandleFunc("/tunnels", a.method(http.MethodGet, a.tunnels))
+	mux.HandleFunc("/tunnels/", a.method(http.MethodDelete, a.closeTunnel))
+	mux.HandleFunc("/upstreams", a.method(http.MethodGet, a.upstreams))
+	mux.HandleFunc("/routes", a.method(http.MethodGet, a.routes))
+	mux.HandleFunc("/outbounds", a.method(http.MethodGet, a.outbounds))
+	mux.HandleFunc("/outbounds/", a.method(http.MethodPut, a.switchOutbound))
+	mux.HandleFunc("/reload", a.method(http.MethodPost, a.reload))
+	mux.HandleFunc("/reload/geoip", a.method(http.MethodPost, a.reloadGeoIP))
+	a.http = &http.Server{Handler: a.auth(mux)}
+	return a, nil
+}
+
+func (a *admin) Run() {
+	err := a.http.Serve(a.listener)
+	if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		logrus.WithError(err).Error("admin server stopped")
+	}
+}
+
+func (a *admin) Close() error {
+	return a.http.Shutdown(context.Background())
+}
+
+func (a *admin) stop() {
+	if err := a.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.WithError(err).Debug("fail to close admin listener")
+	}
+	go a.Close()
+}
+
+func (a *admin) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(header[len("Bearer "):]), []byte(a.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Debug("fail to write admin response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *admin) listeners(w http.ResponseWriter, r *http.Request) {
+	views := make([]listenerView, 0)
+	for key, ss := range a.server.listeners() {
+		chain := ss.Chain()
+		names := make([]string, 0, len(chain.Configs))
+		for _, m := range chain.Configs {
+			name, _ := m["name"].(string)
+			names = append(names, name)
+		}
+		views = append(views, listenerView{
+			Key: key,
+			Network: ss.Network,
+			Address: ss.Address,
+			Connections: ss.Connections(),
+			Tunnels: len(ss.Tunnels()),
+			Streams: names,
+		})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Key < views[j].Key
+	})
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *admin) drain(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("listener")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("listener not found in query"))
+		return
+	}
+	if err := a.server.drain(key); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"listener": key, "status": "draining"})
+}
+
+func (a *admin) chains(w http.ResponseWriter, r *http.Request) {
+	views := make([]chainView, 0)
+	for key, ss := range a.server.listeners() {
+		chain := ss.Chain()
+		configs := make([]interface{}, len(chain.Configs))
+		for i, m := range chain.Configs {
+			configs[i] = redact(m)
+		}
+		views = append(views, chainView{Key: key, Config: configs})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Key < views[j].Key
+	})
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *admin) tunnels(w http.ResponseWriter, r *http.Request) {
+	views := make([]tunnelView, 0)
+	for _, ss := range a.server.listeners() {
+		for _, t := range ss.Tunnels() {
+			views = append(views, tunnelView{
+				ID: t.ID,
+				Listener: t.Listener,
+				Source: t.Source,
+				Target: t.Target,
+				Stream: t.Stream,
+				Outbound: t.Outbound,
+				User: t.User,
+				Upload: t.Upload(),
+				Download: t.Download(),
+				Start: t.Start,
+			})
+		}
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].ID < views[j].ID
+	})
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *admin) closeTunnel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/tunnels/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, ss := range a.server.listeners() {
+		for _, t := range ss.Tunnels() {
+			if t.ID == id {
+				t.Close("closed by admin")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, errors.New("tunnel "+strconv.FormatUint(id, 10)+" not found"))
+}
+
+func (a *admin) upstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, metrics.Upstreams())
+}
+
+func (a *admin) routes(w http.ResponseWriter, r *http.Request) {
+	routes, err := metrics.RouteStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+func (a *admin) outbounds(w http.ResponseWriter, r *http.Request) {
+	views := make([]outboundView, 0)
+	for _, s := range dialer.Selects() {
+		views = append(views, outboundView{
+			Tag: s.Tag,
+			Selected: s.Current(),
+			Options: s.Options(),
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *admin) switchOutbound(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(r.URL.Path, "/outbounds/")
+	s, ok := dialer.GetSelect(tag)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("outbound "+tag+" not found"))
+		return
+	}
+	var body struct {
+		Selected string `json:"selected"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Switch(body.Selected); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"tag": tag, "selected": body.Selected}).Info("outbound switched by admin")
+	writeJSON(w, http.StatusOK, outboundView{Tag: s.Tag, Selected: s.Current(), Options: s.Options()})
+}
+
+func (a *admin) reload(w http.ResponseWriter, r *http.Request) {
+	if err := a.server.reload(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (a *admin) reloadGeoIP(w http.ResponseWriter, r *http.Request) {
+	if err := a.server.reloadRules(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/gchange/subsurface-stream/socks5"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"time"
+)
+
+type socksClient struct {
+	proxy string
+	username string
+	password string
+	timeout time.Duration
+	connect time.Duration
+	handshake time.Duration
+}
+
+func (c *socksClient) dial(ctx context.Context, target string) (net.Conn, error) {
+	addr, err := socks5.ParseAddress(target)
+	if err != nil {
+		return nil, err
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", c.proxy)
+	if err != nil {
+		return nil, err
+	}
+	c.connect = time.Since(start)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	start = time.Now()
+	_, err = socks5.Socks5ClientUser(conn, addr, c.username, c.password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.handshake = time.Since(start)
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (c *socksClient) pipe(target string) error {
+	conn, err := c.dial(context.Background(), target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+func (c *socksClient) get(rawURL string, body bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "http":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "https":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		default:
+			return fmt.Errorf("unsupported scheme %s", u.Scheme)
+		}
+	}
+
+	var tlsStart, tlsDone, wrote, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return c.dial(ctx, host)
+		},
+		DisableKeepAlives: true,
+	}
+	client := &http.Client{Transport: transport, Timeout: c.timeout}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out io.Writer = ioutil.Discard
+	if body {
+		out = os.Stdout
+	}
+	n, err := io.Copy(out, resp.Body)
+	if err != nil {
+		return err
+	}
+	total := time.Since(start)
+
+	w := bufio.NewWriter(os.Stderr)
+	defer w.Flush()
+	fmt.Fprintf(w, "status:     %s\n", resp.Status)
+	fmt.Fprintf(w, "bytes:      %d\n", n)
+	fmt.Fprintf(w, "connect:    %s\n", c.connect)
+	fmt.Fprintf(w, "handshake:  %s\n", c.handshake)
+	if !tlsStart.IsZero() && !tlsDone.IsZero() {
+		fmt.Fprintf(w, "tls:        %s\n", tlsDone.Sub(tlsStart))
+	}
+	if !wrote.IsZero() && !firstByte.IsZero() {
+		fmt.Fprintf(w, "first byte: %s\n", firstByte.Sub(wrote))
+	}
+	fmt.Fprintf(w, "total:      %s\n", total)
+	return nil
+}
+
+func clientCommand(args []string) int {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	proxy := flags.String("proxy", "127.0.0.1:1080", "socks5 proxy address")
+	username := flags.String("username", "", "socks5 username")
+	password := flags.String("password", "", "socks5 password")
+	timeout := flags.Duration("timeout", 10*time.Second, "connect and request timeout")
+	get := flags.String("get", "", "send an HTTP GET to this URL and print timings")
+	body := flags.Bool("body", false, "write the response body of -get to stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+  client [flags] host:port    pipe stdin and stdout through the proxy,
+                              e.g. ssh -o ProxyCommand="%s client -proxy 127.0.0.1:1080 %%h:%%p"
+  client [flags] -get URL     fetch URL through the proxy and print timings
+
+Flags:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *password == "" {
+		*password = os.Getenv("SUBSURFACE_PASSWORD")
+	}
+
+	c := &socksClient{
+		proxy: *proxy,
+		username: *username,
+		password: *password,
+		timeout: *timeout,
+	}
+	var err error
+	switch {
+	case *get != "" && flags.NArg() == 0:
+		err = c.get(*get, *body)
+	case *get == "" && flags.NArg() == 1:
+		err = c.pipe(flags.Arg(0))
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "client: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gchange/subsurface-stream/schema"
+	"github.com/gchange/subsurface-stream/socks5"
+	"github.com/gchange/subsurface-stream/steam"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var version = "dev"
+
+func (config *Config) Validate() error {
+	var errs parser.Errors
+	errs.Add(parser.Prefix("logger", config.LogrusConfig.Validate()))
+	if config.Admin != nil {
+		errs.Add(parser.Prefix("admin", config.Admin.Validate()))
+	}
+	seen := make(map[string]bool, len(config.SubsurfaceStream))
+	for i := range config.SubsurfaceStream {
+		c := &config.SubsurfaceStream[i]
+		path := config.streamPath(i)
+		key := streamKey(c)
+		if seen[c.Address] {
+			errs.Add(parser.Prefix(path, errors.New("duplicate listener "+key)))
+			continue
+		}
+		seen[c.Address] = true
+		chain, err := c.NewChain()
+		if err != nil {
+			errs.Add(parser.Prefix(path, err))
+			continue
+		}
+		chain.Close()
+	}
+	for i := range config.Nameserver {
+		ns, err := config.Nameserver[i].Build()
+		if err != nil {
+			errs.Add(parser.Prefix("nameserver["+strconv.Itoa(i)+"]", err))
+			continue
+		}
+		ns.Close()
+	}
+	return errs.Err()
+}
+
+func reported(errs parser.Errors, err error) bool {
+	e, ok := err.(*parser.Error)
+	if !ok {
+		return false
+	}
+	for _, r := range errs {
+		if r, ok := r.(*parser.Error); ok && strings.HasPrefix(r.Path, e.Path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func printError(prefix string, err error) {
+	if errs, ok := err.(parser.Errors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", prefix, e)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", prefix, err)
+}
+
+func quiet() {
+	logrus.SetOutput(ioutil.Discard)
+}
+
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	fileName := flags.String("config", "config.json", "config file (.json, .yaml or .toml)")
+	flags.BoolVar(&strictConfig, "strict", false, "reject unknown config keys")
+	flags.Parse(args)
+	quiet()
+	var errs parser.Errors
+	config, err := loadConfig(*fileName)
+	errs.Add(err)
+	if config != nil {
+		var more parser.Errors
+		more.Add(config.Validate())
+		for _, e := range more {
+			if !reported(errs, e) {
+				errs = append(errs, e)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		printError(*fileName, errs)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *fileName)
+	return 0
+}
+
+func route(args []string) int {
+	flags := flag.NewFlagSet("route", flag.ExitOnError)
+	fileName := flags.String("config", "config.json", "config file (.json, .yaml or .toml)")
+	flags.BoolVar(&strictConfig, "strict", false, "reject unknown config keys")
+	listener := flags.String("listener", "", "only show the listener with this network/address key")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: route [-config file] [-listener key] host:port")
+		return 2
+	}
+	quiet()
+	addr, err := socks5.ParseAddress(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid target %s: %v\n", flags.Arg(0), err)
+		return 2
+	}
+	config, err := loadConfig(*fileName)
+	if err != nil {
+		printError(*fileName, err)
+		return 1
+	}
+
+	found := false
+	for i := range config.SubsurfaceStream {
+		c := &config.SubsurfaceStream[i]
+		key := streamKey(c)
+		if *listener != "" && *listener != key {
+			continue
+		}
+		chain, err := c.NewChain()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "subsurface %s: %v\n", key, err)
+			return 1
+		}
+		for _, s := range chain.Streams {
+			if courier, ok := s.(*stream.CourierConfig); ok {
+				outbound, rule := courier.Route(addr, "")
+				fmt.Printf("%s\tcourier\t%s\t%s\n", key, outbound, rule)
+				found = true
+			}
+		}
+		chain.Close()
+	}
+	if addr.Domain != "" && *listener == "" {
+		for i := range config.Nameserver {
+			ns, err := config.Nameserver[i].Build()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "nameserver %s: %v\n", config.Nameserver[i].Address, err)
+				return 1
+			}
+			outbound, rule := ns.Route(addr.Domain)
+			fmt.Printf("%s\tnameserver\t%s\t%s\n", config.Nameserver[i].Address, outbound, rule)
+			ns.Close()
+			found = true
+		}
+	}
+	if !found {
+		fmt.Fprintln(os.Stderr, "no routing stream found")
+		return 1
+	}
+	return 0
+}
+
+func printSchema(args []string) int {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	output := flags.String("o", "", "write the schema to this file instead of stdout")
+	flags.Parse(args)
+	buf, err := json.MarshalIndent(schema.Generate("json", defaultConfig()), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "schema: %v\n", err)
+		return 1
+	}
+	buf = append(buf, '\n')
+	if *output == "" {
+		os.Stdout.Write(buf)
+		return 0
+	}
+	err = ioutil.WriteFile(*output, buf, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "schema: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printVersion(args []string) int {
+	fmt.Printf("subsurface-stream %s %s %s/%s\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gchange/subsurface-stream/parser"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const includeKey = "include"
+
+var (
+	strictConfig = false
+	envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+)
+
+func decodeFile(fileName string) (interface{}, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		err = json.Unmarshal(buf, &data)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &data)
+	case ".toml":
+		m := make(map[string]interface{})
+		_, err = toml.Decode(string(buf), &m)
+		data = m
+	default:
+		return nil, errors.New("unsupported config format " + filepath.Ext(fileName))
+	}
+	return data, err
+}
+
+func expandEnv(s string) (string, error) {
+	var err error
+	s = envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(groups[1]); ok {
+			return value
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		if err == nil {
+			err = errors.New("environment variable " + groups[1] + " not set")
+		}
+		return match
+	})
+	return s, err
+}
+
+type configLoader struct {
+	loading map[string]bool
+}
+
+func (loader *configLoader) load(fileName string) (interface{}, error) {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if loader.loading[abs] {
+		return nil, errors.New("include cycle at " + fileName)
+	}
+	loader.loading[abs] = true
+	defer delete(loader.loading, abs)
+	data, err := decodeFile(fileName)
+	if err == nil {
+		data, _, err = loader.resolve(data, filepath.Dir(fileName))
+	}
+	if err != nil && len(loader.loading) > 1 {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return data, err
+}
+
+func (loader *configLoader) includes(value interface{}, dir string) ([]interface{}, error) {
+	var names []string
+	switch v := value.(type) {
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			name, ok := item.(string)
+			if !ok {
+				return nil, errors.New("include must be a file name or a list of file names")
+			}
+			names = append(names, name)
+		}
+	default:
+		return nil, errors.New("include must be a file name or a list of file names")
+	}
+	list := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		name, err := expandEnv(name)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		data, err := loader.load(name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, data)
+	}
+	return list, nil
+}
+
+func (loader *configLoader) resolveMap(m map[string]interface{}, dir string) (interface{}, bool, error) {
+	merged := make(map[string]interface{}, len(m))
+	var items []interface{}
+	if value, ok := m[includeKey]; ok {
+		included, err := loader.includes(value, dir)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, data := range included {
+			switch v := data.(type) {
+			case map[string]interface{}:
+				for key, value := range v {
+					merged[key] = value
+				}
+			case []interface{}:
+				items = append(items, v...)
+			default:
+				return nil, false, errors.New("included file must hold an object or a list")
+			}
+		}
+		if items != nil {
+			if len(merged) != 0 || len(m) != 1 {
+				return nil, false, errors.New("an include of lists can not be mixed with other keys")
+			}
+			return items, true, nil
+		}
+	}
+	for key, value := range m {
+		if key == includeKey {
+			continue
+		}
+		value, _, err := loader.resolve(value, dir)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", key, err)
+		}
+		merged[key] = value
+	}
+	return merged, false, nil
+}
+
+func (loader *configLoader) resolve(data interface{}, dir string) (interface{}, bool, error) {
+	switch v := data.(type) {
+	case string:
+		s, err := expandEnv(v)
+		return s, false, err
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = value
+		}
+		return loader.resolveMap(m, dir)
+	case map[string]interface{}:
+		return loader.resolveMap(v, dir)
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = item
+		}
+		return loader.resolve(list, dir)
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			value, splice, err := loader.resolve(item, dir)
+			if err != nil {
+				return nil, false, err
+			}
+			if splice {
+				list = append(list, value.([]interface{})...)
+			} else {
+				list = append(list, value)
+			}
+		}
+		return list, false, nil
+	default:
+		return data, false, nil
+	}
+}
+
+func readConfig(fileName string, config *Config) (parser.Errors, error) {
+	loader := &configLoader{loading: make(map[string]bool)}
+	data, err := loader.load(fileName)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("config must be an object")
+	}
+	unmarshal := parser.Unmarshal
+	if strictConfig || m["strict"] == true {
+		unmarshal = parser.UnmarshalStrict
+	}
+	var errs parser.Errors
+	errs.Add(unmarshal("json", reflect.ValueOf(config), m))
+	return errs, nil
+}
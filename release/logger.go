@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/socks5"
+	"github.com/gchange/subsurface-stream/steam"
+	"github.com/gchange/subsurface-stream/tunnel"
+	"github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"time"
+)
+
+type LogOutput struct {
+	Format string `json:"format" validate:"oneof=json text" description:"log format"`
+	Output string `json:"output" validate:"oneof=stdout stderr file syslog" description:"log destination"`
+	File string `json:"file" description:"log file for the file output"`
+	MaxSize int `json:"max_size" description:"rotate the log file at this size in megabytes"`
+	MaxBackups int `json:"max_backups" description:"rotated files to keep"`
+	MaxAge int `json:"max_age" description:"days to keep rotated files"`
+	Compress bool `json:"compress" description:"gzip rotated files"`
+	RotateInterval time.Duration `json:"rotate_interval" description:"also rotate the log file at this interval"`
+	SyslogTag string `json:"syslog_tag" description:"syslog tag"`
+}
+
+type LogrusConfig struct {
+	Level string `json:"level" validate:"oneof=panic fatal error warn warning info debug trace" description:"log level"`
+	LogOutput
+	Subsystems map[string]string `json:"subsystems" description:"log levels by subsystem: socks5, dialer or courier"`
+	Access *LogOutput `json:"access" description:"separate output for the access log"`
+}
+
+type rotator struct {
+	*lumberjack.Logger
+	ticker *time.Ticker
+	done chan struct{}
+}
+
+var (
+	subsystems = map[string]**logrus.Logger{
+		"socks5": &socks5.Logger,
+		"dialer": &dialer.Logger,
+		"courier": &stream.CourierLogger,
+	}
+	logClosers = make([]io.Closer, 0)
+)
+
+func (r *rotator) rotate() {
+	for {
+		select {
+		case <-r.ticker.C:
+			if err := r.Rotate(); err != nil {
+				logrus.WithError(err).WithField("file", r.Filename).Error("fail to rotate log file")
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *rotator) Close() error {
+	if r.ticker != nil {
+		r.ticker.Stop()
+		close(r.done)
+	}
+	return r.Logger.Close()
+}
+
+func (output *LogOutput) configure(logger *logrus.Logger) (io.Closer, error) {
+	switch output.Format {
+	case "", "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return nil, errors.New("unsupported log format " + output.Format)
+	}
+
+	logger.ReplaceHooks(make(logrus.LevelHooks))
+	switch output.Output {
+	case "", "stdout":
+		logger.SetOutput(os.Stdout)
+	case "stderr":
+		logger.SetOutput(os.Stderr)
+	case "file":
+		if output.File == "" {
+			return nil, errors.New("log file not found")
+		}
+		r := &rotator{
+			Logger: &lumberjack.Logger{
+				Filename: output.File,
+				MaxSize: output.MaxSize,
+				MaxBackups: output.MaxBackups,
+				MaxAge: output.MaxAge,
+				Compress: output.Compress,
+				LocalTime: true,
+			},
+		}
+		if output.RotateInterval < 0 {
+			return nil, errors.New("invalid rotate interval")
+		}
+		if output.RotateInterval > 0 {
+			r.ticker = time.NewTicker(output.RotateInterval)
+			r.done = make(chan struct{})
+			go r.rotate()
+		}
+		logger.SetOutput(r)
+		return r, nil
+	case "syslog":
+		tag := output.SyslogTag
+		if tag == "" {
+			tag = "subsurface"
+		}
+		hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return nil, err
+		}
+		logger.AddHook(hook)
+		logger.SetOutput(ioutil.Discard)
+		return hook.Writer, nil
+	default:
+		return nil, errors.New("unsupported log output " + output.Output)
+	}
+	return nil, nil
+}
+
+func (output *LogOutput) Validate() error {
+	switch output.Format {
+	case "", "json", "text":
+	default:
+		return errors.New("unsupported log format " + output.Format)
+	}
+	switch output.Output {
+	case "", "stdout", "stderr", "syslog":
+	case "file":
+		if output.File == "" {
+			return errors.New("log file not found")
+		}
+		if output.RotateInterval < 0 {
+			return errors.New("invalid rotate interval")
+		}
+	default:
+		return errors.New("unsupported log output " + output.Output)
+	}
+	return nil
+}
+
+func (config *LogrusConfig) Validate() error {
+	if _, err := logrus.ParseLevel(config.Level); err != nil {
+		return err
+	}
+	for name, l := range config.Subsystems {
+		if _, ok := subsystems[name]; !ok {
+			return errors.New("unknown log subsystem " + name)
+		}
+		if _, err := logrus.ParseLevel(l); err != nil {
+			return err
+		}
+	}
+	if err := config.LogOutput.Validate(); err != nil {
+		return err
+	}
+	if config.Access != nil {
+		return config.Access.Validate()
+	}
+	return nil
+}
+
+func subsystemLogger(base *logrus.Logger, level logrus.Level) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(base.Out)
+	logger.SetFormatter(base.Formatter)
+	logger.ReplaceHooks(base.Hooks)
+	logger.SetLevel(level)
+	return logger
+}
+
+func (config *LogrusConfig) Init() error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	level, _ := logrus.ParseLevel(config.Level)
+	levels := make(map[string]logrus.Level, len(config.Subsystems))
+	for name, l := range config.Subsystems {
+		levels[name], _ = logrus.ParseLevel(l)
+	}
+
+	closers := make([]io.Closer, 0, 2)
+	base := logrus.New()
+	closer, err := config.LogOutput.configure(base)
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		closers = append(closers, closer)
+	}
+	access := base
+	if config.Access != nil {
+		access = logrus.New()
+		closer, err = config.Access.configure(access)
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+			return err
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+	}
+
+	std := logrus.StandardLogger()
+	std.SetOutput(base.Out)
+	std.SetFormatter(base.Formatter)
+	std.ReplaceHooks(base.Hooks)
+	std.SetLevel(level)
+	for name, logger := range subsystems {
+		if l, ok := levels[name]; ok {
+			*logger = subsystemLogger(std, l)
+		} else {
+			*logger = std
+		}
+	}
+	if config.Access != nil {
+		access.SetLevel(logrus.InfoLevel)
+		tunnel.AccessLogger = access
+	} else {
+		tunnel.AccessLogger = std
+	}
+
+	logClosers = closers
+	return nil
+}
+
+func closeLogs() {
+	for _, c := range logClosers {
+		c.Close()
+	}
+	logClosers = nil
+}
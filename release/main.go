@@ -1,70 +1,132 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
+	"fmt"
 	"github.com/gchange/subsurface-stream"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/nameserver"
+	"github.com/gchange/subsurface-stream/parser"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
-type LogrusConfig struct {
-}
-
 type Config struct {
-	LogrusConfig LogrusConfig `json:"logger"`
-	SubsurfaceStream []subsurface_stream.Config `json:"subsurface"`
-}
-
-func (config *LogrusConfig) Init() error {
-	logrus.SetFormatter(&logrus.JSONFormatter{})
-	logrus.SetOutput(os.Stdout)
-	logrus.SetLevel(logrus.DebugLevel)
-	return nil
+	LogrusConfig LogrusConfig `json:"logger" description:"logging"`
+	SubsurfaceStream []subsurface_stream.Config `json:"subsurface" description:"listeners"`
+	Client *ClientConfig `json:"client" description:"local client profile, expands into a listener"`
+	Nameserver []nameserver.Config `json:"nameserver" description:"DNS servers"`
+	Metrics *metrics.Config `json:"metrics" description:"Prometheus metrics server"`
+	Admin *AdminConfig `json:"admin" description:"admin HTTP API"`
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" default:"30s" description:"how long to drain connections on shutdown"`
+	Strict bool `json:"strict" description:"reject unknown config keys"`
 }
 
-func main() {
-	flag.Parse()
-	fileName := flag.String("config", "config.json", "json config file")
-	buf, err := ioutil.ReadFile(*fileName)
+func run(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	fileName := flags.String("config", "config.json", "config file (.json, .yaml or .toml)")
+	flags.BoolVar(&strictConfig, "strict", false, "reject unknown config keys")
+	flags.Parse(args)
+	config, err := loadConfig(*fileName)
 	if err != nil {
-		logrus.WithError(err).WithField("file", fileName).Panic("fail to read config file")
+		printError(*fileName, err)
+		return 1
 	}
 
-	var config Config
-	err = json.Unmarshal(buf, &config)
+	err = config.LogrusConfig.Init()
 	if err != nil {
-		logrus.WithError(err).WithField("config", string(buf)).Panic("fail to unmarshal config")
+		printError(*fileName, parser.Prefix("logger", err))
+		return 1
 	}
 
-	err = config.LogrusConfig.Init()
+	s := newServer(*fileName, config)
+	err = s.start()
 	if err != nil {
-		logrus.WithError(err).WithField("config", config.LogrusConfig).Panic("fail to init logrus")
+		s.shutdown(context.Background())
+		logrus.WithError(err).Error("fail to start subsurface stream")
+		closeLogs()
+		return 1
 	}
 
-	streams := make([]*subsurface_stream.SubsurfaceStream, 0)
-	defer func() {
-		for _, ss := range streams {
-			ss.Close()
+	logrus.Info("start subsurface stream")
+	defer closeLogs()
+	defer logrus.Info("exit subsurface stream")
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range sc {
+		if sig != syscall.SIGHUP {
+			break
 		}
-	}()
-	for _, c := range config.SubsurfaceStream {
-		ss, err := c.New()
-		if err != nil {
-			logrus.WithError(err).WithField("config", c).Panic("fail to init stream")
+		logrus.WithField("file", *fileName).Info("reload subsurface stream")
+		if err := s.reload(); err != nil {
+			logrus.WithError(err).Error("invalid config, keep the running one")
 		}
-		streams = append(streams, ss)
-		go ss.Run()
-		logrus.WithField("config", c).Debug("run stream")
 	}
 
-	logrus.Info("start subsurface stream")
-	defer logrus.Info("exit subsurface stream")
+	logrus.WithField("timeout", s.shutdownTimeout.String()).Info("shutdown subsurface stream")
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case sig := <-sc:
+				if sig == syscall.SIGHUP {
+					continue
+				}
+				logrus.Warn("force shutdown subsurface stream")
+				cancel()
+			case <-ctx.Done():
+			}
+			return
+		}
+	}()
+	s.shutdown(ctx)
+	return 0
+}
 
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGTERM, syscall.SIGINT)
-	<-sc
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [arguments]
+
+Commands:
+  run [-config file] [-strict]                    run the proxy (default)
+  validate [-config file] [-strict]               check the config file and exit
+  route [-config file] [-listener key] host:port  show which outbound a target takes
+  client [flags] host:port | -get URL             SOCKS5 client, see "client -h"
+  schema [-o file]                                print the JSON Schema of the config file
+  version                                         print the version
+`, os.Args[0])
+}
+
+func main() {
+	args := os.Args[1:]
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "run":
+		os.Exit(run(args))
+	case "validate":
+		os.Exit(validate(args))
+	case "route":
+		os.Exit(route(args))
+	case "client":
+		os.Exit(clientCommand(args))
+	case "schema":
+		os.Exit(printSchema(args))
+	case "version":
+		os.Exit(printVersion(args))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
+	}
 }
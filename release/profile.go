@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"github.com/gchange/subsurface-stream"
+)
+
+type ClientConfig struct {
+	Listen string `json:"listen" validate:"address" description:"local HTTP and SOCKS5 listen address"`
+	Server string `json:"server" validate:"address" description:"address of the remote subsurface-stream node"`
+	Transport string `json:"transport" validate:"oneof=tls tcp ws wss" description:"transport to the remote node, ws and wss tunnel through WebSocket"`
+	Path string `json:"path" description:"WebSocket path on the remote node for the ws and wss transports"`
+	Mux bool `json:"mux" description:"multiplex all connections over one transport connection"`
+	ServerName string `json:"server_name" description:"TLS server name, defaults to the server host"`
+	Insecure bool `json:"insecure" description:"skip TLS certificate verification"`
+	CA string `json:"ca" description:"PEM file of trusted CA certificates"`
+	Username string `json:"username" description:"SOCKS5 username on the remote node"`
+	Password string `json:"password" description:"SOCKS5 password on the remote node"`
+	IPv4 string `json:"ipv4" description:"IPv4 country list CSV file"`
+	IPv6 string `json:"ipv6" description:"IPv6 country list CSV file"`
+	Domains string `json:"domains" description:"domain rule CSV file"`
+	Country string `json:"country" description:"local country code, discovered when empty; while it is unknown every IP target goes through the proxy"`
+	Sniff bool `json:"sniff" description:"sniff TLS SNI and HTTP Host of IP targets"`
+}
+
+func (config *ClientConfig) Stream() (subsurface_stream.Config, error) {
+	if config.Server == "" {
+		return subsurface_stream.Config{}, errors.New("client server address not found")
+	}
+	listen := config.Listen
+	if listen == "" {
+		listen = "127.0.0.1:1080"
+	}
+	proxyDialer := map[string]interface{}{"name": "direct"}
+	switch config.Transport {
+	case "", "tls", "wss":
+		proxyDialer = map[string]interface{}{
+			"name": "tls",
+			"server_name": config.ServerName,
+			"insecure": config.Insecure,
+			"ca": config.CA,
+			"dialer": proxyDialer,
+		}
+	case "tcp", "ws":
+	default:
+		return subsurface_stream.Config{}, errors.New("unsupported client transport " + config.Transport)
+	}
+	if config.Transport == "ws" || config.Transport == "wss" {
+		proxyDialer = map[string]interface{}{
+			"name": "websocket",
+			"dialer": proxyDialer,
+		}
+		if config.Path != "" {
+			proxyDialer["path"] = config.Path
+		}
+	}
+	if config.Mux {
+		proxyDialer = map[string]interface{}{
+			"name": "mux",
+			"dialer": proxyDialer,
+		}
+	}
+	courier := map[string]interface{}{
+		"name": "courier",
+		"network": "tcp",
+		"address": config.Server,
+		"username": config.Username,
+		"password": config.Password,
+		"http": true,
+		"sniff": config.Sniff,
+		"ipv4": config.IPv4,
+		"ipv6": config.IPv6,
+		"domains": config.Domains,
+		"country": config.Country,
+		"dialer": map[string]interface{}{"name": "direct"},
+		"proxy_dialer": proxyDialer,
+	}
+	return subsurface_stream.Config{
+		Network: "tcp",
+		Address: listen,
+		Configs: []map[string]interface{}{courier},
+	}, nil
+}
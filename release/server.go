@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gchange/subsurface-stream"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/nameserver"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type server struct {
+	fileName string
+	config *Config
+	shutdownTimeout time.Duration
+	streams map[string]*subsurface_stream.SubsurfaceStream
+	nameservers []*nameserver.Nameserver
+	metrics *metrics.Metrics
+	admin *admin
+	removing map[*subsurface_stream.SubsurfaceStream]string
+	lock sync.Mutex
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		LogrusConfig: LogrusConfig{Level: "debug"},
+	}
+}
+
+func loadConfig(fileName string) (*Config, error) {
+	config := defaultConfig()
+	errs, err := readConfig(fileName, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Client != nil {
+		c, err := config.Client.Stream()
+		if err != nil {
+			errs.Add(parser.Prefix("client", err))
+		} else {
+			config.SubsurfaceStream = append(config.SubsurfaceStream, c)
+		}
+	}
+	return config, errs.Err()
+}
+
+func streamKey(config *subsurface_stream.Config) string {
+	return config.Network + "/" + config.Address
+}
+
+func (config *Config) streamPath(i int) string {
+	if config.Client != nil && i == len(config.SubsurfaceStream)-1 {
+		return "client"
+	}
+	return "subsurface[" + strconv.Itoa(i) + "]"
+}
+
+func sameConfig(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+func newServer(fileName string, config *Config) *server {
+	return &server{
+		fileName: fileName,
+		config: config,
+		shutdownTimeout: config.ShutdownTimeout,
+		streams: make(map[string]*subsurface_stream.SubsurfaceStream, 0),
+		nameservers: make([]*nameserver.Nameserver, 0),
+		removing: make(map[*subsurface_stream.SubsurfaceStream]string, 0),
+	}
+}
+
+func (s *server) start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	if s.config.Metrics != nil {
+		s.metrics, err = s.config.Metrics.New()
+		if err != nil {
+			return err
+		}
+		go s.metrics.Run()
+	}
+	if s.config.Admin != nil {
+		s.admin, err = s.config.Admin.New(s)
+		if err != nil {
+			return err
+		}
+		go s.admin.Run()
+	}
+
+	for i := range s.config.SubsurfaceStream {
+		c := &s.config.SubsurfaceStream[i]
+		key := streamKey(c)
+		if _, ss := s.streamAt(c.Address); ss != nil {
+			return errors.New("duplicate listener " + key)
+		}
+		ss, err := c.New()
+		if err != nil {
+			return parser.Prefix(s.config.streamPath(i), err)
+		}
+		s.streams[key] = ss
+		go ss.Run()
+		logrus.WithField("config", c).Debug("run stream")
+	}
+
+	for _, c := range s.config.Nameserver {
+		ns, err := c.New()
+		if err != nil {
+			return err
+		}
+		s.nameservers = append(s.nameservers, ns)
+		ns.Run()
+		logrus.WithField("config", c).Debug("run nameserver")
+	}
+	return nil
+}
+
+func (s *server) reload() error {
+	config, err := loadConfig(s.fileName)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seen := make(map[string]bool, len(config.SubsurfaceStream))
+	kept := make(map[string]bool, len(config.SubsurfaceStream))
+	chains := make(map[string]*subsurface_stream.Chain, 0)
+	rebinds := make(map[string]*subsurface_stream.Config, 0)
+	added := make(map[string]*subsurface_stream.SubsurfaceStream, 0)
+	rollback := func() {
+		for _, chain := range chains {
+			chain.Close()
+		}
+		for _, ss := range added {
+			ss.Close()
+		}
+	}
+	for i := range config.SubsurfaceStream {
+		c := &config.SubsurfaceStream[i]
+		key := streamKey(c)
+		if seen[c.Address] {
+			rollback()
+			return errors.New("duplicate listener " + key)
+		}
+		seen[c.Address] = true
+		oldKey, ss := s.streamAt(c.Address)
+		if ss == nil {
+			ss, err = c.New()
+			if err != nil {
+				rollback()
+				return parser.Prefix(config.streamPath(i), err)
+			}
+			added[key] = ss
+			continue
+		}
+		kept[oldKey] = true
+		if oldKey == key && sameConfig(ss.Chain().Config, c) {
+			continue
+		}
+		chain, err := c.NewChain()
+		if err != nil {
+			rollback()
+			return parser.Prefix(config.streamPath(i), err)
+		}
+		chains[oldKey] = chain
+		if oldKey != key {
+			rebinds[oldKey] = c
+		}
+	}
+
+	var errs parser.Errors
+	for key, ss := range s.streams {
+		if !kept[key] {
+			s.remove(key, config.ShutdownTimeout)
+			continue
+		}
+		chain, ok := chains[key]
+		if !ok {
+			if err := ss.Reload(); err != nil {
+				logrus.WithError(err).WithField("listener", key).Error("fail to reload stream")
+			}
+			continue
+		}
+		if c, ok := rebinds[key]; ok {
+			if err := ss.CloseListener(); err != nil {
+				logrus.WithError(err).WithField("listener", key).Debug("fail to close listener")
+			}
+			s.remove(key, config.ShutdownTimeout)
+			next, err := c.Listen(chain)
+			if err != nil {
+				logrus.WithError(err).WithField("listener", streamKey(c)).Error("fail to rebind stream")
+				errs.Add(err)
+				continue
+			}
+			added[streamKey(c)] = next
+			continue
+		}
+		if err := ss.Swap(chain); err != nil {
+			logrus.WithError(err).WithField("listener", key).Error("fail to swap stream chain")
+			chain.Close()
+			continue
+		}
+		logrus.WithField("listener", key).Info("stream chain updated")
+	}
+	for key, ss := range added {
+		s.streams[key] = ss
+		go ss.Run()
+		logrus.WithField("listener", key).Info("stream added")
+	}
+
+	for _, reload := range []func(*Config) error{s.reloadLogger, s.reloadNameservers, s.reloadMetrics, s.reloadAdmin} {
+		if err := reload(config); err != nil {
+			errs.Add(err)
+		}
+	}
+	s.config = config
+	s.shutdownTimeout = config.ShutdownTimeout
+	return errs.Err()
+}
+
+func (s *server) streamAt(address string) (string, *subsurface_stream.SubsurfaceStream) {
+	for key, ss := range s.streams {
+		if ss.Address == address {
+			return key, ss
+		}
+	}
+	return "", nil
+}
+
+func (s *server) reloadLogger(config *Config) error {
+	if sameConfig(s.config.LogrusConfig, config.LogrusConfig) {
+		return nil
+	}
+	closers := logClosers
+	if err := config.LogrusConfig.Init(); err != nil {
+		logrus.WithError(err).Error("fail to reload logger")
+		config.LogrusConfig = s.config.LogrusConfig
+		return err
+	}
+	for _, c := range closers {
+		c.Close()
+	}
+	logrus.Info("logger reloaded")
+	return nil
+}
+
+func (s *server) reloadNameservers(config *Config) error {
+	if sameConfig(s.config.Nameserver, config.Nameserver) {
+		return nil
+	}
+	for _, ns := range s.nameservers {
+		ns.Close()
+	}
+	s.nameservers = make([]*nameserver.Nameserver, 0, len(config.Nameserver))
+	var errs parser.Errors
+	for i := range config.Nameserver {
+		ns, err := config.Nameserver[i].New()
+		if err != nil {
+			logrus.WithError(err).WithField("address", config.Nameserver[i].Address).Error("fail to reload nameserver")
+			errs.Add(err)
+			continue
+		}
+		s.nameservers = append(s.nameservers, ns)
+		ns.Run()
+	}
+	logrus.Info("nameservers reloaded")
+	return errs.Err()
+}
+
+func (s *server) reloadMetrics(config *Config) error {
+	if sameConfig(s.config.Metrics, config.Metrics) {
+		return nil
+	}
+	if s.metrics != nil {
+		s.metrics.Close()
+		s.metrics = nil
+	}
+	if config.Metrics == nil {
+		return nil
+	}
+	m, err := config.Metrics.New()
+	if err != nil {
+		logrus.WithError(err).Error("fail to reload metrics")
+		return err
+	}
+	s.metrics = m
+	go m.Run()
+	logrus.Info("metrics reloaded")
+	return nil
+}
+
+func (s *server) reloadAdmin(config *Config) error {
+	if sameConfig(s.config.Admin, config.Admin) {
+		return nil
+	}
+	if s.admin != nil {
+		s.admin.stop()
+		s.admin = nil
+	}
+	if config.Admin == nil {
+		return nil
+	}
+	a, err := config.Admin.New(s)
+	if err != nil {
+		logrus.WithError(err).Error("fail to reload admin")
+		return err
+	}
+	s.admin = a
+	go a.Run()
+	logrus.Info("admin reloaded")
+	return nil
+}
+
+func (s *server) remove(key string, timeout time.Duration) {
+	ss := s.streams[key]
+	delete(s.streams, key)
+	s.removing[ss] = key
+	go func() {
+		defer func() {
+			s.lock.Lock()
+			delete(s.removing, ss)
+			s.lock.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := ss.Shutdown(ctx); err != nil {
+			logrus.WithError(err).WithField("listener", key).Warn("stream shutdown incomplete")
+		}
+		logrus.WithField("listener", key).Info("stream removed")
+	}()
+}
+
+func (s *server) drain(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.streams[key]; !ok {
+		return errors.New("listener " + key + " not found")
+	}
+	s.remove(key, s.shutdownTimeout)
+	return nil
+}
+
+func (s *server) reloadRules() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	for key, ss := range s.streams {
+		if e := ss.Reload(); e != nil {
+			logrus.WithError(e).WithField("listener", key).Error("fail to reload stream")
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *server) listeners() map[string]*subsurface_stream.SubsurfaceStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	streams := make(map[string]*subsurface_stream.SubsurfaceStream, len(s.streams))
+	for key, ss := range s.streams {
+		streams[key] = ss
+	}
+	return streams
+}
+
+func (s *server) shutdown(ctx context.Context) {
+	s.lock.Lock()
+	streams := make(map[*subsurface_stream.SubsurfaceStream]string, len(s.streams)+len(s.removing))
+	for key, ss := range s.streams {
+		streams[ss] = key
+	}
+	for ss, key := range s.removing {
+		streams[ss] = key
+	}
+	s.lock.Unlock()
+
+	wg := sync.WaitGroup{}
+	for ss, key := range streams {
+		wg.Add(1)
+		go func(key string, ss *subsurface_stream.SubsurfaceStream) {
+			defer wg.Done()
+			if err := ss.Shutdown(ctx); err != nil {
+				logrus.WithError(err).WithField("listener", key).Warn("stream shutdown incomplete")
+			}
+		}(key, ss)
+	}
+	wg.Wait()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, ns := range s.nameservers {
+		ns.Close()
+	}
+	if s.metrics != nil {
+		s.metrics.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+}
@@ -0,0 +1,134 @@
+package resolver
+
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/parser"
+	"net"
+	"sync"
+	"time"
+)
+
+type CacheConfig struct {
+	Size           uint                   `subsurface:"size" description:"maximum cached names"`
+	TTL            time.Duration          `subsurface:"ttl" default:"1m" description:"lifetime of cached answers without a TTL"`
+	Resolver       map[string]interface{} `subsurface:"resolver" schema:"resolver" description:"resolver to cache"`
+	resolverConfig Config
+}
+
+type cacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+type Cache struct {
+	*CacheConfig
+	resolver Resolver
+	entries  map[string]cacheEntry
+	lock     sync.RWMutex
+}
+
+func (config *CacheConfig) Init() error {
+	var err error
+	config.resolverConfig, err = GetResolverConfig(config.Resolver)
+	if err != nil {
+		return parser.Prefix("resolver", err)
+	}
+	return parser.Prefix("resolver", config.resolverConfig.Init())
+}
+
+func (config *CacheConfig) Clone() Config {
+	return &CacheConfig{
+		Size:           config.Size,
+		TTL:            config.TTL,
+		Resolver:       config.Resolver,
+		resolverConfig: config.resolverConfig,
+	}
+}
+
+func (config *CacheConfig) New() (Resolver, error) {
+	resolver, err := config.resolverConfig.New()
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		CacheConfig: config,
+		resolver:    resolver,
+		entries:     make(map[string]cacheEntry, config.Size),
+	}, nil
+}
+
+func (cache *Cache) get(key string) ([]net.IP, time.Duration, bool) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	ttl := time.Until(entry.expire)
+	if ttl <= 0 {
+		return nil, 0, false
+	}
+	return append([]net.IP(nil), entry.ips...), ttl, true
+}
+
+func (cache *Cache) set(key string, ips []net.IP, ttl time.Duration) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if uint(len(cache.entries)) >= cache.Size {
+		now := time.Now()
+		for k, entry := range cache.entries {
+			if entry.expire.Before(now) {
+				delete(cache.entries, k)
+			}
+		}
+		for k := range cache.entries {
+			if uint(len(cache.entries)) < cache.Size {
+				break
+			}
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = cacheEntry{ips, time.Now().Add(ttl)}
+}
+
+func (cache *Cache) LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	key := IPNetwork(network) + "/" + host
+	if ips, ttl, ok := cache.get(key); ok {
+		return ips, ttl, nil
+	}
+
+	var ips []net.IP
+	var err error
+	ttl := cache.TTL
+	if r, ok := cache.resolver.(TTLResolver); ok {
+		var t time.Duration
+		ips, t, err = r.LookupIPTTL(ctx, network, host)
+		if t > 0 {
+			ttl = t
+		}
+	} else {
+		ips, err = cache.resolver.LookupIP(ctx, network, host)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if cache.Size > 0 && ttl > 0 {
+		cache.set(key, ips, ttl)
+	}
+	return ips, ttl, nil
+}
+
+func (cache *Cache) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := cache.LookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+func init() {
+	config := &CacheConfig{
+		Size: 4096,
+	}
+	Register("cache", config)
+}
@@ -0,0 +1,217 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type DNSConfig struct {
+	Network    string        `subsurface:"network" validate:"oneof=udp tcp tls https" description:"DNS transport"`
+	Address    string        `subsurface:"address" required:"true" description:"server address, or a URL for https"`
+	ServerName string        `subsurface:"server_name" description:"TLS server name for tls and https"`
+	Timeout    time.Duration `subsurface:"timeout" default:"5s" description:"query timeout"`
+}
+
+type DNS struct {
+	*DNSConfig
+	client     *dns.Client
+	httpClient *http.Client
+}
+
+func (config *DNSConfig) Init() error {
+	switch config.Network {
+	case "udp", "tcp":
+		config.Address = defaultPort(config.Address, "53")
+	case "tls":
+		config.Address = defaultPort(config.Address, "853")
+	case "https":
+	default:
+		return errors.New("unsupported dns network " + config.Network)
+	}
+	return nil
+}
+
+func (config *DNSConfig) Clone() Config {
+	return &DNSConfig{
+		Network:    config.Network,
+		Address:    config.Address,
+		ServerName: config.ServerName,
+		Timeout:    config.Timeout,
+	}
+}
+
+func (config *DNSConfig) New() (Resolver, error) {
+	d := &DNS{DNSConfig: config}
+	switch config.Network {
+	case "https":
+		d.httpClient = &http.Client{Timeout: config.Timeout}
+	case "tls":
+		serverName := config.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(config.Address)
+		}
+		d.client = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   config.Timeout,
+			TLSConfig: &tls.Config{ServerName: serverName},
+		}
+	default:
+		d.client = &dns.Client{
+			Net:     config.Network,
+			Timeout: config.Timeout,
+		}
+	}
+	return d, nil
+}
+
+func defaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, port)
+	}
+	return address
+}
+
+func (d *DNS) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if d.httpClient == nil {
+		resp, _, err := d.client.ExchangeContext(ctx, msg, d.Address)
+		return resp, err
+	}
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.Address, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected doh status " + resp.Status)
+	}
+	buf, err = ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	reply := &dns.Msg{}
+	err = reply.Unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (d *DNS) query(ctx context.Context, host string, qtype uint16) ([]net.IP, uint32, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	msg.RecursionDesired = true
+	reply, err := d.Exchange(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return nil, 0, errors.New("dns query failed with " + dns.RcodeToString[reply.Rcode])
+	}
+	ips := make([]net.IP, 0, len(reply.Answer))
+	var ttl uint32
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if len(ips) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		ips = append(ips, ip)
+	}
+	return ips, ttl, nil
+}
+
+func (d *DNS) LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	var qtypes []uint16
+	switch IPNetwork(network) {
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	results := make([]result, len(qtypes))
+	wg := sync.WaitGroup{}
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			ips, ttl, err := d.query(ctx, host, qtype)
+			results[i] = result{ips, ttl, err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl uint32
+	var err error
+	for _, r := range results {
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		if len(r.ips) == 0 {
+			continue
+		}
+		if len(ips) == 0 || r.ttl < ttl {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, Server: d.Address, IsNotFound: true}
+		}
+		return nil, 0, err
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func (d *DNS) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := d.LookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+func init() {
+	config := &DNSConfig{
+		Network: "udp",
+	}
+	Register("dns", config)
+}
@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/parser"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const hostsTTL = time.Minute
+
+type HostsConfig struct {
+	File           string                 `subsurface:"file" description:"hosts file to load"`
+	Hosts          map[string]interface{} `subsurface:"hosts" description:"static names, each mapped to an address or a list of addresses"`
+	Resolver       map[string]interface{} `subsurface:"resolver" schema:"resolver" description:"resolver for names not found in the hosts"`
+	hosts          map[string][]net.IP
+	resolverConfig Config
+}
+
+type Hosts struct {
+	*HostsConfig
+	resolver Resolver
+}
+
+func LoadHosts(name string, hosts map[string][]net.IP) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, host := range fields[1:] {
+			host = strings.ToLower(host)
+			hosts[host] = append(hosts[host], ip)
+		}
+	}
+	return scanner.Err()
+}
+
+func (config *HostsConfig) Init() error {
+	config.hosts = make(map[string][]net.IP, len(config.Hosts))
+	if config.File != "" {
+		if err := LoadHosts(config.File, config.hosts); err != nil {
+			return err
+		}
+	}
+	for host, value := range config.Hosts {
+		var addresses []interface{}
+		switch value := value.(type) {
+		case string:
+			addresses = []interface{}{value}
+		case []interface{}:
+			addresses = value
+		default:
+			return errors.New("invalid hosts entry " + host)
+		}
+		host = strings.ToLower(host)
+		for _, address := range addresses {
+			s, _ := address.(string)
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.New("invalid hosts address for " + host)
+			}
+			config.hosts[host] = append(config.hosts[host], ip)
+		}
+	}
+	if config.Resolver != nil {
+		var err error
+		config.resolverConfig, err = GetResolverConfig(config.Resolver)
+		if err != nil {
+			return parser.Prefix("resolver", err)
+		}
+		return parser.Prefix("resolver", config.resolverConfig.Init())
+	}
+	return nil
+}
+
+func (config *HostsConfig) Clone() Config {
+	return &HostsConfig{
+		File:           config.File,
+		Hosts:          config.Hosts,
+		Resolver:       config.Resolver,
+		hosts:          config.hosts,
+		resolverConfig: config.resolverConfig,
+	}
+}
+
+func (config *HostsConfig) New() (Resolver, error) {
+	hosts := &Hosts{HostsConfig: config}
+	if config.resolverConfig != nil {
+		var err error
+		hosts.resolver, err = config.resolverConfig.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hosts, nil
+}
+
+func (hosts *Hosts) LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	if ips, ok := hosts.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		network = IPNetwork(network)
+		matched := make([]net.IP, 0, len(ips))
+		for _, ip := range ips {
+			isIPv4 := ip.To4() != nil
+			if network == "ip" || (network == "ip4") == isIPv4 {
+				matched = append(matched, ip)
+			}
+		}
+		if len(matched) > 0 {
+			return matched, hostsTTL, nil
+		}
+	}
+	if hosts.resolver == nil {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if r, ok := hosts.resolver.(TTLResolver); ok {
+		return r.LookupIPTTL(ctx, network, host)
+	}
+	ips, err := hosts.resolver.LookupIP(ctx, network, host)
+	return ips, 0, err
+}
+
+func (hosts *Hosts) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := hosts.LookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+func init() {
+	Register("hosts", &HostsConfig{})
+}
@@ -0,0 +1,139 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/parser"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	lock         = sync.RWMutex{}
+	resolverPool = map[string]Config{}
+)
+
+type Config interface {
+	Init() error
+	Clone() Config
+	New() (Resolver, error)
+}
+
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+type TTLResolver interface {
+	Resolver
+	LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+func Register(name string, config Config) error {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := resolverPool[name]; ok {
+		return errors.New("config already exists")
+	}
+	resolverPool[name] = config
+	return nil
+}
+
+func GetResolverConfig(config map[string]interface{}) (Config, error) {
+	var name string
+	if n, ok := config["name"]; !ok {
+		return nil, errors.New("config name not found")
+	} else if name, ok = n.(string); !ok {
+		return nil, errors.New("config name type error")
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+	if c, ok := resolverPool[name]; ok {
+		nc := c.Clone()
+		err := parser.Unmarshal("subsurface", reflect.ValueOf(nc), config, "name")
+		if err != nil {
+			return nil, err
+		}
+		return nc, nil
+	}
+	return nil, parser.UnknownName("resolver", name, names())
+}
+
+func names() []string {
+	list := make([]string, 0, len(resolverPool))
+	for name := range resolverPool {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func Names() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return names()
+}
+
+func init() {
+	parser.RegisterKind("resolver", "subsurface", prototype)
+}
+
+func prototype(name string) (interface{}, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if c, ok := resolverPool[name]; ok {
+		return c.Clone(), true
+	}
+	return nil, false
+}
+
+func Configs() map[string]Config {
+	lock.RLock()
+	defer lock.RUnlock()
+	configs := make(map[string]Config, len(resolverPool))
+	for name, config := range resolverPool {
+		configs[name] = config.Clone()
+	}
+	return configs
+}
+
+func New(config map[string]interface{}) (Resolver, error) {
+	resolverConfig, err := GetResolverConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	err = resolverConfig.Init()
+	if err != nil {
+		return nil, err
+	}
+	return resolverConfig.New()
+}
+
+func IPNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4", "ip4":
+		return "ip4"
+	case "tcp6", "udp6", "ip6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+func Sort(ips []net.IP, prefer string) []net.IP {
+	if prefer != "ipv4" && prefer != "ipv6" {
+		return ips
+	}
+	ips = append([]net.IP(nil), ips...)
+	sort.SliceStable(ips, func(i, j int) bool {
+		iv4, jv4 := ips[i].To4() != nil, ips[j].To4() != nil
+		if prefer == "ipv4" {
+			return iv4 && !jv4
+		}
+		return !iv4 && jv4
+	})
+	return ips
+}
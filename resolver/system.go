@@ -0,0 +1,33 @@
+package resolver
+
+import (
+	"context"
+	"net"
+)
+
+type SystemConfig struct {
+}
+
+type System struct {
+	resolver *net.Resolver
+}
+
+func (config *SystemConfig) Init() error {
+	return nil
+}
+
+func (config *SystemConfig) Clone() Config {
+	return &SystemConfig{}
+}
+
+func (config *SystemConfig) New() (Resolver, error) {
+	return &System{net.DefaultResolver}, nil
+}
+
+func (system *System) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return system.resolver.LookupIP(ctx, network, host)
+}
+
+func init() {
+	Register("system", &SystemConfig{})
+}
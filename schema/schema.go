@@ -0,0 +1,292 @@
+package schema
+
+import (
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/resolver"
+	"github.com/gchange/subsurface-stream/steam"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Draft           = "https://json-schema.org/draft/2020-12/schema"
+	durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+	addressPattern  = `^.*:[0-9]{1,5}$`
+	cidrPattern     = `^.+/[0-9]{1,3}$`
+	envPattern      = `\$\{[A-Za-z_][A-Za-z0-9_]*`
+	registryTag     = "subsurface"
+	includeKey      = "include"
+)
+
+type Schema map[string]interface{}
+
+type generator struct {
+	defs map[string]interface{}
+}
+
+func ref(name string) Schema {
+	return Schema{"$ref": "#/$defs/" + name}
+}
+
+func fieldKey(tagName string, tf reflect.StructField) string {
+	if tag := tf.Tag.Get(tagName); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(tf.Name)
+}
+
+func sortedNames(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.String()
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *generator) registry(kind string, configs map[string]interface{}) {
+	variants := make([]interface{}, 0, len(configs))
+	for _, name := range sortedNames(configs) {
+		val := reflect.Indirect(reflect.ValueOf(configs[name]))
+		s := g.object(registryTag, val)
+		properties := s["properties"].(Schema)
+		properties["name"] = Schema{"const": name}
+		s["required"] = []string{"name"}
+		s["title"] = kind + " " + name
+		def := kind + "." + name
+		g.defs[def] = s
+		variants = append(variants, ref(def))
+	}
+	g.defs[kind] = Schema{
+		"type": "object",
+		"properties": Schema{
+			"name": Schema{"enum": sortedNames(configs)},
+		},
+		"if":   Schema{"required": []string{"name"}},
+		"then": Schema{"oneOf": variants},
+		"else": Schema{"required": []string{includeKey}},
+	}
+}
+
+func (g *generator) object(tagName string, val reflect.Value) Schema {
+	properties := Schema{}
+	required := make([]string, 0)
+	g.fields(tagName, val, properties, &required)
+	properties[includeKey] = ref(includeKey)
+	s := Schema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["anyOf"] = []Schema{{"required": []string{includeKey}}, {"required": required}}
+	}
+	return s
+}
+
+func (g *generator) fields(tagName string, val reflect.Value, properties Schema, required *[]string) {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		tf := typ.Field(i)
+		if tf.PkgPath != "" {
+			continue
+		}
+		key := fieldKey(tagName, tf)
+		if key == "-" {
+			continue
+		}
+		vf := val.Field(i)
+		if tf.Anonymous && tf.Type.Kind() == reflect.Struct && tf.Tag.Get(tagName) == "" {
+			g.fields(tagName, vf, properties, required)
+			continue
+		}
+		properties[key] = g.field(tagName, tf, vf)
+		if r, _ := strconv.ParseBool(tf.Tag.Get("required")); r {
+			*required = append(*required, key)
+		}
+	}
+}
+
+func (g *generator) field(tagName string, tf reflect.StructField, val reflect.Value) Schema {
+	var s Schema
+	switch kind := tf.Tag.Get("schema"); {
+	case strings.HasPrefix(kind, "values:"):
+		s = Schema{
+			"type":                 "object",
+			"properties":           Schema{includeKey: ref(includeKey)},
+			"additionalProperties": g.named(strings.TrimPrefix(kind, "values:")),
+		}
+	case kind != "" && tf.Type.Kind() == reflect.Slice:
+		s = Schema{"type": "array", "items": g.named(kind)}
+	case kind != "":
+		s = g.named(kind)
+	default:
+		s = g.value(tagName, tf.Type, val)
+	}
+	if description := tf.Tag.Get("description"); description != "" {
+		s["description"] = description
+	}
+	if def, ok := tf.Tag.Lookup("default"); ok {
+		s["default"] = typedDefault(tf.Type, def)
+	} else if val.IsValid() && !val.IsZero() && isScalar(val) {
+		s["default"] = val.Interface()
+		if val.Type() == reflect.TypeOf(time.Duration(0)) {
+			s["default"] = val.Interface().(time.Duration).String()
+		}
+	}
+	rule := tf.Tag.Get("validate")
+	switch {
+	case rule == "duration":
+		s["pattern"] = durationPattern
+	case rule == "address":
+		s["pattern"] = addressPattern
+	case rule == "cidr":
+		s["pattern"] = cidrPattern
+	case rule == "url":
+		s["format"] = "uri"
+	case rule == "ip":
+		s["anyOf"] = []Schema{{"format": "ipv4"}, {"format": "ipv6"}}
+	case strings.HasPrefix(rule, "oneof="):
+		s["enum"] = strings.Split(strings.TrimPrefix(rule, "oneof="), " ")
+	}
+	return allowEnv(s)
+}
+
+func typedDefault(typ reflect.Type, def string) interface{} {
+	var v interface{}
+	var err error
+	switch typ.Kind() {
+	case reflect.Bool:
+		v, err = strconv.ParseBool(def)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if typ == reflect.TypeOf(time.Duration(0)) {
+			return def
+		}
+		v, err = strconv.ParseInt(def, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err = strconv.ParseUint(def, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		v, err = strconv.ParseFloat(def, 64)
+	default:
+		return def
+	}
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func allowEnv(s Schema) Schema {
+	typ, _ := s["type"].(string)
+	if typ == "object" || typ == "array" || s["$ref"] != nil {
+		return s
+	}
+	if typ == "string" && s["pattern"] == nil && s["enum"] == nil && s["format"] == nil && s["anyOf"] == nil {
+		return s
+	}
+	value := Schema{}
+	wrapped := Schema{"anyOf": []Schema{value, ref("env")}}
+	for key, v := range s {
+		switch key {
+		case "description", "default":
+			wrapped[key] = v
+		default:
+			value[key] = v
+		}
+	}
+	return wrapped
+}
+
+func (g *generator) named(kind string) Schema {
+	switch kind {
+	case "string", "integer", "number", "boolean":
+		return Schema{"type": kind}
+	default:
+		return ref(kind)
+	}
+}
+
+func isScalar(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *generator) value(tagName string, typ reflect.Type, val reflect.Value) Schema {
+	if typ == reflect.TypeOf(time.Duration(0)) {
+		return Schema{"type": []string{"string", "number"}, "pattern": durationPattern}
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Ptr:
+		if val.IsValid() && !val.IsNil() {
+			return g.value(tagName, typ.Elem(), val.Elem())
+		}
+		return g.value(tagName, typ.Elem(), reflect.Zero(typ.Elem()))
+	case reflect.Struct:
+		if !val.IsValid() {
+			val = reflect.Zero(typ)
+		}
+		return g.object(tagName, val)
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": g.value(tagName, typ.Elem(), reflect.Value{})}
+	case reflect.Map:
+		return Schema{
+			"type":                 "object",
+			"properties":           Schema{includeKey: ref(includeKey)},
+			"additionalProperties": g.value(tagName, typ.Elem(), reflect.Value{}),
+		}
+	default:
+		return Schema{}
+	}
+}
+
+func convert(configs interface{}) map[string]interface{} {
+	m := reflect.ValueOf(configs)
+	converted := make(map[string]interface{}, m.Len())
+	for _, key := range m.MapKeys() {
+		converted[key.String()] = m.MapIndex(key).Interface()
+	}
+	return converted
+}
+
+func Generate(tagName string, root interface{}) Schema {
+	g := &generator{defs: map[string]interface{}{
+		includeKey: Schema{
+			"description": "file or list of files merged into this object, relative to the including file",
+			"anyOf":       []Schema{{"type": "string"}, {"type": "array", "items": Schema{"type": "string"}}},
+		},
+		"env": Schema{
+			"description": "reference to an environment variable, expanded before the value is checked",
+			"type":        "string",
+			"pattern":     envPattern,
+		},
+	}}
+	g.registry("stream", convert(stream.Configs()))
+	g.registry("dialer", convert(dialer.Configs()))
+	g.registry("resolver", convert(resolver.Configs()))
+	s := g.value(tagName, reflect.TypeOf(root), reflect.ValueOf(root))
+	s["$schema"] = Draft
+	s["description"] = "Strings may reference environment variables as ${VAR}, and any object may merge other files with include."
+	s["$defs"] = g.defs
+	return s
+}
@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/parser"
+	"io"
+	"net"
+	"time"
+)
+
+type ClientConfig struct {
+	Network string `subsurface:"network" description:"network of the SOCKS5 server"`
+	Address string `subsurface:"address" validate:"address" description:"address of the SOCKS5 server"`
+	Username string `subsurface:"username" description:"SOCKS5 username"`
+	Password string `subsurface:"password" description:"SOCKS5 password"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer used to reach the SOCKS5 server"`
+	dialerConfig dialer.Config
+}
+
+type Client struct {
+	*ClientConfig
+	dialer dialer.Dialer
+}
+
+func (config *ClientConfig) Init() error {
+	if config.Address == "" {
+		return errors.New("socks5 server address not found")
+	}
+	var err error
+	config.dialerConfig, err = dialer.GetDialerConfig(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
+	}
+	return parser.Prefix("dialer", config.dialerConfig.Init())
+}
+
+func (config *ClientConfig) Clone() dialer.Config {
+	return &ClientConfig{
+		Network: config.Network,
+		Address: config.Address,
+		Username: config.Username,
+		Password: config.Password,
+		Dialer: config.Dialer,
+		dialerConfig: config.dialerConfig,
+	}
+}
+
+func (config *ClientConfig) New() (dialer.Dialer, error) {
+	d, err := config.dialerConfig.New()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{config, d}, nil
+}
+
+func (client *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("socks5 client does not support " + network)
+	}
+	addr, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.dialer.DialContext(ctx, client.Network, client.Address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	_, err = Socks5ClientUser(conn, addr, client.Username, client.Password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (client *Client) Close() error {
+	if closer, ok := client.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	config := &ClientConfig{
+		Network: "tcp",
+	}
+	dialer.Register("socks5", config)
+}
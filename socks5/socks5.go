@@ -1,237 +1,391 @@
 package socks5
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/fakeip"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/tunnel"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"strconv"
-	"strings"
 )
 
-func Copy(dst, src net.Conn) {
-	defer dst.Close()
-	for {
-		if n, err := io.Copy(dst, src); err != nil || n == 0 {
-			logrus.WithError(err).Debug("copy socks5 failed")
-			break
+var Logger = logrus.StandardLogger()
+
+type Address struct {
+	IP net.IP
+	Domain string
+	Port uint16
+}
+
+func ParseAddress(address string) (*Address, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	addr := &Address{Port: uint16(p)}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP = ip
+	} else {
+		addr.Domain = host
+	}
+	return addr, nil
+}
+
+func RestoreFakeIP(addr *Address) (*Address, func()) {
+	if addr.Domain != "" || addr.IP == nil {
+		return addr, func() {}
+	}
+	if domain, release, ok := fakeip.Acquire(addr.IP); ok {
+		return &Address{Domain: domain, Port: addr.Port}, release
+	}
+	return addr, func() {}
+}
+
+func (addr *Address) Host() string {
+	if addr.Domain != "" {
+		return addr.Domain
+	}
+	if addr.IP == nil {
+		return net.IPv4zero.String()
+	}
+	return addr.IP.String()
+}
+
+func (addr *Address) String() string {
+	return net.JoinHostPort(addr.Host(), strconv.Itoa(int(addr.Port)))
+}
+
+func appendAddress(buf []byte, addr *Address) ([]byte, error) {
+	if addr.Domain != "" {
+		if len(addr.Domain) > 255 {
+			return nil, errors.New("domain too long")
 		}
+		buf = append(buf, 3, uint8(len(addr.Domain)))
+		buf = append(buf, addr.Domain...)
+	} else if ip := addr.IP.To4(); ip != nil {
+		buf = append(buf, 1)
+		buf = append(buf, ip...)
+	} else if ip := addr.IP.To16(); ip != nil {
+		buf = append(buf, 4)
+		buf = append(buf, ip...)
+	} else {
+		buf = append(buf, 1)
+		buf = append(buf, net.IPv4zero.To4()...)
 	}
+	return append(buf, uint8(addr.Port>>8), uint8(addr.Port)), nil
 }
 
-func Socks5Client(conn net.Conn, ip net.IP, port uint16) (net.IP, uint16, error) {
-	_, err := conn.Write([]byte{5, 1, 0})
+func readAddress(conn net.Conn, atyp uint8) (*Address, error) {
+	addr := &Address{}
+	switch atyp {
+	case 1:
+		addr.IP = make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(conn, addr.IP); err != nil {
+			return nil, err
+		}
+	case 3:
+		var domainLen uint8
+		err := binary.Read(conn, binary.BigEndian, &domainLen)
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, domainLen)
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		addr.Domain = string(domain)
+	case 4:
+		addr.IP = make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(conn, addr.IP); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported protocol")
+	}
+	err := binary.Read(conn, binary.BigEndian, &addr.Port)
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func Socks5Client(conn net.Conn, addr *Address) (*Address, error) {
+	return Socks5ClientUser(conn, addr, "", "")
+}
+
+func Socks5ClientUser(conn net.Conn, addr *Address, username, password string) (*Address, error) {
+	method := uint8(0)
+	if username != "" {
+		if len(username) > 255 || len(password) > 255 {
+			return nil, errors.New("username or password too long")
+		}
+		method = 2
+	}
+	_, err := conn.Write([]byte{5, 1, method})
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	buf := make([]uint8, 2, 2)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	if buf[0] != 5 || buf[1] != 0 {
-		return nil, 0, errors.New("unsupported protocol")
+	if buf[0] != 5 || buf[1] != method {
+		return nil, errors.New("unsupported protocol")
 	}
-	buf = []byte{5, 1, 0, 0}
-	if ip := ip.To4();ip != nil {
-		buf[3] = 1
-		buf = append(buf, ip...)
-	} else if ip := ip.To16(); ip != nil {
-		buf[3] = 4
-		buf = append(buf, ip...)
-	} else {
-		buf[3] = 3
-		buf = append(buf, uint8(len(ip)))
-		buf = append(buf, ip...)
+	if method == 2 {
+		req := append([]byte{1, uint8(len(username))}, username...)
+		req = append(append(req, uint8(len(password))), password...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		if buf[0] != 1 || buf[1] != 0 {
+			return nil, errors.New("authentication failed")
+		}
 	}
-	_, err = conn.Write(buf)
+	request, err := appendAddress([]byte{5, 1, 0}, addr)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	err = binary.Write(conn, binary.BigEndian, &port)
+	_, err = conn.Write(request)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	buf = make([]uint8, 4, 4)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	if buf[0] != 5 || buf[1] != 0 || buf[2] != 0 {
-		return nil, 0, errors.New("connect failed")
+		return nil, errors.New("connect failed")
 	}
-	var bindIP net.IP
-	switch buf[3] {
-	case 1:
-		bindIP = make(net.IP, net.IPv4len)
-	case 3:
-		var bindLen uint8
-		err = binary.Read(conn, binary.BigEndian, &bindLen)
-		bindIP = make(net.IP, bindLen)
-	case 4:
-		bindIP = make(net.IP, net.IPv6len)
+	return readAddress(conn, buf[3])
+}
+
+func authenticate(conn net.Conn, users map[string]string) (string, error) {
+	buf := make([]uint8, 2, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return "", err
 	}
-	_, err = io.ReadFull(conn, bindIP)
+	if buf[0] != 1 {
+		return "", errors.New("unsupported auth version")
+	}
+	username := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.ReadFull(conn, buf[:1])
 	if err != nil {
-		return nil, 0, err
+		return "", err
 	}
-	var bindPort uint16
-	err = binary.Read(conn, binary.BigEndian, &bindPort)
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
 	if err != nil {
-		return nil, 0, err
+		return "", err
+	}
+	if p, ok := users[string(username)]; !ok || p != string(password) {
+		conn.Write([]byte{1, 1})
+		return "", errors.New("authentication failed for user " + string(username))
 	}
-	return bindIP, bindPort, nil
+	_, err = conn.Write([]byte{1, 0})
+	if err != nil {
+		return "", err
+	}
+	return string(username), nil
+}
+
+func Decode(conn net.Conn) (*Address, error) {
+	addr, _, err := DecodeUser(conn, nil)
+	return addr, err
 }
 
-func Decode(conn net.Conn) (net.IP, uint16, error) {
+func DecodeUser(conn net.Conn, users map[string]string) (*Address, string, error) {
 	buf := make([]uint8, 2, 2)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, 0, err
+		return nil, "", err
 	}
 	if buf[0] != 5 {
-		return nil, 0, errors.New("unsupported protocol")
+		return nil, "", errors.New("unsupported protocol")
 	}
 	if buf[1] == 0 {
-		return nil, 0, errors.New("missing verify method")
+		return nil, "", errors.New("missing verify method")
 	}
 	buf = make([]uint8, buf[1], buf[1])
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, 0, err
+		return nil, "", err
+	}
+	var method uint8
+	if len(users) != 0 {
+		method = 2
 	}
 	flag := false
 	for _, n := range buf {
-		if n == 0 {
+		if n == method {
 			flag = true
 			break
 		}
 	}
 	if !flag {
-		return nil, 0, errors.New("unsupported protocol")
+		conn.Write([]byte{5, 0xff})
+		return nil, "", errors.New("unsupported protocol")
 	}
-	_, err = conn.Write([]byte{5, 0})
+	_, err = conn.Write([]byte{5, method})
 	if err != nil {
-		return nil, 0, err
-	}
-	buf = make([]byte, 4, 4)
-	_, err = io.ReadFull(conn, buf)
-	if err != nil {return nil, 0, err}
-	if buf[0] != 5 || buf[1] != 1 || buf[2] != 0 {
-		return nil, 0, errors.New("unsupported protocol")
+		return nil, "", err
 	}
-	var ip net.IP
-	switch buf[3] {
-	case 1:
-		ip = make(net.IP, net.IPv4len)
-	case 3:
-		var ipLen uint8
-		err = binary.Read(conn, binary.BigEndian, &ipLen)
+	var user string
+	if method == 2 {
+		user, err = authenticate(conn, users)
 		if err != nil {
-			return nil, 0, err
+			return nil, "", err
 		}
-		ip = make(net.IP, ipLen)
-	case 4:
-		ip = make(net.IP, net.IPv6len)
-	default:
-		return nil, 0, errors.New("unsupported protocol")
 	}
-	_, err = io.ReadFull(conn, ip)
-	if err != nil {
-		return nil, 0, err
+	buf = make([]byte, 4, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {return nil, "", err}
+	if buf[0] != 5 || buf[1] != 1 || buf[2] != 0 {
+		return nil, "", errors.New("unsupported protocol")
 	}
-	var port uint16
-	err = binary.Read(conn, binary.BigEndian, &port)
+	addr, err := readAddress(conn, buf[3])
 	if err != nil {
-		return nil, 0, err
+		return nil, "", err
 	}
-	return ip, port, nil
+	return addr, user, nil
 }
 
-func EncodeBindAddress(conn net.Conn, address string) error {
-	var ip net.IP
-	var port int
-	var err error
-	index := strings.LastIndex(address, ":")
-	if index > 0 {
-		ip = net.ParseIP(address[:index])
-		port, err = strconv.Atoi(address[index+1:])
-		if err != nil {
-			return err
-		}
-	} else {
-		ip = []byte(address)
-		port = 0
+func setUser(ctx context.Context, user string) {
+	if metadata, ok := dialer.MetadataFromContext(ctx); ok {
+		metadata.User = user
 	}
-	return EncodeIPAndPort(conn, ip, uint16(port))
 }
 
-func EncodeIPAndPort(conn net.Conn, ip net.IP, port uint16) error {
-	buf := []byte{5, 0, 0, 0}
-	if ip := ip.To4(); ip != nil {
-		buf[3] = 1
-		buf = append(buf, ip...)
-	} else if ip := ip.To16(); ip != nil {
-		buf[3] = 4
-		buf = append(buf, ip...)
-	} else {
-		buf[3] = 3
-		buf = append(buf, uint8(len(ip)))
-		buf = append(buf, ip...)
-	}
-	_, err := conn.Write(buf)
-	if  err != nil {
+func EncodeReply(conn net.Conn, reply uint8, addr *Address) error {
+	buf, err := appendAddress([]byte{5, reply, 0}, addr)
+	if err != nil {
 		return err
 	}
-	err = binary.Write(conn, binary.BigEndian, &port)
+	_, err = conn.Write(buf)
+	return err
+}
+
+func EncodeAddress(conn net.Conn, addr *Address) error {
+	return EncodeReply(conn, 0, addr)
+}
+
+func EncodeBindAddress(conn net.Conn, address string) error {
+	addr, err := ParseAddress(address)
 	if err != nil {
 		return err
 	}
-	return nil
+	return EncodeAddress(conn, addr)
+}
+
+func EncodeIPAndPort(conn net.Conn, ip net.IP, port uint16) error {
+	return EncodeAddress(conn, &Address{IP: ip, Port: port})
 }
 
-func Socks5Proxy(conn net.Conn, dialer dialer.Dialer, network, address string) (net.Conn, error) {
-	client, err := dialer.Dial(network, address)
+func Socks5Proxy(ctx context.Context, conn net.Conn, d dialer.Dialer, network, address string, users map[string]string) (t *tunnel.Tunnel, err error) {
+	addr, user, err := DecodeUser(conn, users)
 	if err != nil {
 		return nil, err
 	}
-	remoteIP, remotePort, err := Decode(conn)
+	addr, release := RestoreFakeIP(addr)
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+	setUser(ctx, user)
+
+	dialCtx, stop := dialer.WatchClient(ctx, conn)
+	client, err := d.DialContext(dialCtx, network, address)
 	if err != nil {
+		stop()
+		metrics.SetUpstream(address, err)
+		EncodeReply(conn, 1, &Address{})
 		return nil, err
 	}
-	bindIP, bindPort, err := Socks5Client(client, remoteIP, remotePort)
+	metrics.SetUpstream(address, nil)
+	bind, err := Socks5Client(client, addr)
+	extra, watchErr := stop()
 	if err != nil {
+		client.Close()
+		EncodeReply(conn, 1, &Address{})
 		return nil, err
 	}
-	err = EncodeIPAndPort(conn, bindIP, bindPort)
+	if watchErr == nil && len(extra) > 0 {
+		_, watchErr = client.Write(extra)
+	}
+	if watchErr != nil {
+		client.Close()
+		return nil, watchErr
+	}
+	err = EncodeAddress(conn, bind)
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
-	go Copy(client, conn)
-	go Copy(conn, client)
-	return conn, nil
+	t = tunnel.New(ctx, "socks5", "proxy", addr.String(), conn, client)
+	t.OnClose(release)
+	return t, nil
 }
 
-func Socks5Server(conn net.Conn, dialer dialer.Dialer) (net.Conn, error) {
-	remoteIP, remotePort, err := Decode(conn)
+func Socks5Server(ctx context.Context, conn net.Conn, d dialer.Dialer, users map[string]string) (t *tunnel.Tunnel, err error) {
+	addr, user, err := DecodeUser(conn, users)
 	if err != nil {
 		return nil, err
 	}
+	addr, release := RestoreFakeIP(addr)
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+	setUser(ctx, user)
 
-	address := fmt.Sprintf("%s:%d", remoteIP.String(), remotePort)
-	remoteConn, err := dialer.Dial("tcp", address)
+	dialCtx, stop := dialer.WatchClient(ctx, conn)
+	remoteConn, err := d.DialContext(dialCtx, "tcp", addr.String())
+	extra, watchErr := stop()
 	if err != nil {
-		conn.Write([]byte{5, 1, 0})
+		fields := logrus.Fields{"target": addr.String()}
+		if metadata, ok := dialer.MetadataFromContext(ctx); ok {
+			fields["source"] = metadata.Source.String()
+		}
+		Logger.WithError(err).WithFields(fields).Debug("socks5 dial failed")
+		EncodeReply(conn, 1, &Address{})
 		return nil, err
 	}
+	if watchErr == nil && len(extra) > 0 {
+		_, watchErr = remoteConn.Write(extra)
+	}
+	if watchErr != nil {
+		remoteConn.Close()
+		return nil, watchErr
+	}
 	err = EncodeBindAddress(conn, remoteConn.RemoteAddr().String())
 	if err != nil {
+		remoteConn.Close()
 		return nil, err
 	}
-	go Copy(conn, remoteConn)
-	go Copy(remoteConn, conn)
-	return conn, nil
-}
\ No newline at end of file
+	t = tunnel.New(ctx, "socks5", "direct", addr.String(), conn, remoteConn)
+	t.OnClose(release)
+	return t, nil
+}
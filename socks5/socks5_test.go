@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAppendAddress(t *testing.T) {
+	cases := []struct {
+		name string
+		addr *Address
+		want []byte
+		err  bool
+	}{
+		{"ipv4", &Address{IP: net.ParseIP("1.2.3.4"), Port: 80}, []byte{1, 1, 2, 3, 4, 0, 80}, false},
+		{"ipv6", &Address{IP: net.ParseIP("::1"), Port: 443}, append(append([]byte{4}, net.ParseIP("::1")...), 1, 187), false},
+		{"domain", &Address{Domain: "a.b", Port: 53}, []byte{3, 3, 'a', '.', 'b', 0, 53}, false},
+		{"longest domain", &Address{Domain: strings.Repeat("a", 255), Port: 1}, append(append([]byte{3, 255}, strings.Repeat("a", 255)...), 0, 1), false},
+		{"domain too long", &Address{Domain: strings.Repeat("a", 256), Port: 1}, nil, true},
+		{"empty", &Address{}, []byte{1, 0, 0, 0, 0, 0, 0}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := appendAddress(nil, c.addr)
+			if c.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -1,182 +1,169 @@
 package stream
 
 import (
-	"encoding/csv"
-	"encoding/json"
-	"fmt"
+	"bufio"
+	"context"
+	"errors"
 	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gchange/subsurface-stream/resolver"
 	"github.com/gchange/subsurface-stream/socks5"
+	"github.com/gchange/subsurface-stream/tunnel"
+	"github.com/sirupsen/logrus"
+	"io"
 	"net"
-	"net/http"
-	"os"
 	"strconv"
+	"time"
 )
 
-type IPSegment struct {
-	Start uint64
-	End uint64
-	ShortName string
-	Name string
-}
-
-type IPList []IPSegment
+var CourierLogger = logrus.StandardLogger()
 
 type CourierConfig struct {
-	Network string `subsurface:"network"`
-	Address string `subsurface:"address"`
-	IPv4 string `subsurface:"ipv4"`
-	IPv6 string `subsurface:"ipv6"`
-	Dialer map[string]interface{} `subsurface:"dialer"`
-	ipList IPList
+	Network string `subsurface:"network" description:"network of the upstream SOCKS5 proxy"`
+	Address string `subsurface:"address" validate:"address" description:"address of the upstream SOCKS5 proxy, empty sends everything direct"`
+	IPv4 string `subsurface:"ipv4" description:"IPv4 country list CSV file"`
+	IPv6 string `subsurface:"ipv6" description:"IPv6 country list CSV file"`
+	Country string `subsurface:"country" description:"local country code, discovered when empty; while it is unknown every IP target goes through the proxy"`
+	Discovery string `subsurface:"discovery" validate:"oneof=none http stun" description:"how to discover the public address"`
+	DiscoveryURL string `subsurface:"discovery_url" validate:"url" description:"URL returning the public address for http discovery"`
+	STUNServer string `subsurface:"stun_server" validate:"address" description:"STUN server for stun discovery"`
+	DiscoveryTimeout time.Duration `subsurface:"discovery_timeout" default:"5s" description:"timeout of the public address discovery"`
+	Domains string `subsurface:"domains" description:"domain rule CSV file"`
+	ReloadInterval time.Duration `subsurface:"reload_interval" description:"interval between rule file checks, zero disables reloading"`
+	Username string `subsurface:"username" description:"username for the upstream proxy"`
+	Password string `subsurface:"password" description:"password for the upstream proxy"`
+	HTTP bool `subsurface:"http" description:"also accept HTTP proxy requests"`
+	Sniff bool `subsurface:"sniff" description:"sniff TLS SNI and HTTP Host of IP targets"`
+	SniffTimeout time.Duration `subsurface:"sniff_timeout" default:"300ms" description:"how long to wait for sniffable data"`
+	SniffPorts []int `subsurface:"sniff_ports" description:"target ports to sniff, the client is answered before the target is dialed so failed dials show up as resets"`
+	IdleTimeout time.Duration `subsurface:"idle_timeout" default:"5m" description:"close tunnels idle for this long"`
+	Resolver map[string]interface{} `subsurface:"resolver" schema:"resolver" description:"resolver used to route domain targets by IP"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer for direct connections"`
+	ProxyDialer map[string]interface{} `subsurface:"proxy_dialer" schema:"dialer" description:"dialer used to reach the upstream proxy, defaults to dialer"`
+	ruleTable *ruleTable
 	localIP uint64
 	localAddress string
-	country string
+	resolver resolver.Resolver
 	dialer dialer.Dialer
+	proxyDialer dialer.Dialer
 }
 
 type Courier struct {
 	*CourierConfig
 }
 
-func IPToUint64(ip net.IP) uint64 {
-	if ipv4 := ip.To4(); ipv4 != nil {
-		return  uint64(ipv4[0])<<24 + uint64(ipv4[1])<<16 + uint64(ipv4[2])<<8 + uint64(ipv4[3])
-	} else if ipv6 := ip.To16(); ipv6 != nil {
-		return uint64(ipv6[0])<<56+uint64(ipv6[1])<<48+uint64(ipv6[2])<<40+uint64(ipv6[3])<<32+uint64(ipv6[4])<<24+uint64(ipv6[5])<<16<<uint64(ipv6[6])<<8+uint64(ipv6[7])
-	} else {
-		return 0
+func (config *CourierConfig) discover() (net.IP, error) {
+	if config.Discovery == "none" || config.Discovery == "" {
+		return nil, nil
 	}
-}
-
-func (ipList IPList) find(n uint64) int {
-	listLen := len(ipList)
-	i, j, k := 0, listLen, listLen/2
-	for i<j&&k<listLen {
-		if ipList[k].Start > n {
-			j = k
-			k = (i+j)/2
-		} else if ipList[k].End < n {
-			i = k
-			k = (i+j+1)/2
-		} else {
-			break
+	switch config.Discovery {
+	case "http":
+		if config.DiscoveryURL == "" {
+			return nil, errors.New("discovery_url not found for http discovery")
 		}
+		return DiscoverHTTP(config.DiscoveryURL, config.DiscoveryTimeout)
+	case "stun":
+		return DiscoverSTUN(config.STUNServer, config.DiscoveryTimeout)
+	default:
+		return nil, errors.New("unsupported discovery " + config.Discovery)
 	}
-	return k
 }
 
-func (ipList IPList) Find(n uint64) IPSegment {
-	index := ipList.find(n)
-	if index == len(ipList) {
-		return IPSegment{
-			Start: n,
-			End: n,
-			ShortName: "-",
-			Name:"-",
-		}
+func (config *CourierConfig) localCountry(list IPList) string {
+	if config.Country != "" {
+		return config.Country
 	}
-	return ipList[index]
-}
-
-func (ipList IPList) insert(start, end int, seg IPSegment) IPList {
-	listLen := len(ipList)
-		k := ipList.find(seg.Start)
-		if k == listLen {
-			return append(ipList, seg)
-		}
-		newList := append(ipList, ipList[listLen-1])
-		for i:=listLen-1;i>k;i-- {
-			ipList[i] = ipList[i-1]
-		}
-		newList[k] = seg
-		return newList
+	if config.localIP == 0 {
+		return ""
+	}
+	return list.Find(config.localIP).ShortName
 }
 
-func (ipList IPList) Insert(seg IPSegment) IPList {
-	return ipList.insert(0, len(ipList), seg)
+func (config *CourierConfig) Reload() error {
+	err := config.ruleTable.reload(config.localCountry)
+	if err != nil {
+		CourierLogger.WithError(err).WithFields(logrus.Fields{
+			"ipv4": config.IPv4,
+			"ipv6": config.IPv6,
+			"domains": config.Domains,
+		}).Error("fail to reload rules, keep the old ones")
+		return err
+	}
+	snapshot := config.ruleTable.snapshot()
+	CourierLogger.WithFields(logrus.Fields{
+		"segments": len(snapshot.ips),
+		"domains": len(snapshot.domains),
+		"country": snapshot.country,
+	}).Info("reload rules")
+	return nil
 }
 
-func (config *CourierConfig) IPUnmarshal(name string, list IPList) (IPList, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, err
+func (config *CourierConfig) Close() error {
+	if config.ruleTable != nil {
+		config.ruleTable.close()
 	}
-	reader := csv.NewReader(f)
-	for {
-		record, err := reader.Read()
-		if err != nil {
-			break
-		}
-		if len(record) != 4 {
-			continue
-		}
-		start, err := strconv.ParseUint(record[0], 10, 64)
-		if err != nil {
-			continue
-		}
-		end, err := strconv.ParseUint(record[1], 10, 64)
-		if err != nil {
-			continue
-		}
-		seg := IPSegment{
-			Start:start,
-			End: end,
-			ShortName: record[2],
-			Name: record[3],
+	var err error
+	dialers := []dialer.Dialer{config.dialer}
+	if config.proxyDialer != config.dialer {
+		dialers = append(dialers, config.proxyDialer)
+	}
+	for _, d := range dialers {
+		if closer, ok := d.(io.Closer); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
 		}
-		list = list.Insert(seg)
 	}
-	return list, nil
+	return err
 }
 
 func (config *CourierConfig) Init() error {
-	resp, err := http.Get("http://httpbin.org/ip")
-	if err != nil {
-		return err
+	if config.Country == "" {
+		ip, err := config.discover()
+		if err != nil {
+			CourierLogger.WithError(err).WithField("discovery", config.Discovery).Warn("fail to discover local address")
+		} else if ip != nil {
+			config.localIP = IPToUint64(ip)
+			config.localAddress = ip.String()
+		}
 	}
-	defer resp.Body.Close()
-	decoder := json.NewDecoder(resp.Body)
-	data := struct {
-		Origin string `json:"origin"`
-	}{}
-	err = decoder.Decode(&data)
+
+	config.ruleTable = newRuleTable(config.Domains, config.IPv4, config.IPv6)
+	err := config.ruleTable.reload(config.localCountry)
 	if err != nil {
 		return err
 	}
-	ip := net.ParseIP(data.Origin)
-	config.localIP = IPToUint64(ip)
-	config.localAddress = data.Origin
-
-
-	if config.localAddress != "" {
-		config.ipList = make(IPList, 0, 1024)
-		if config.IPv4 != "" {
-			config.ipList, err = config.IPUnmarshal(config.IPv4, config.ipList)
-			if err != nil {
-				return err
-			}
-		}
-		if config.IPv6 != "" {
-			config.ipList, err = config.IPUnmarshal(config.IPv6, config.ipList)
-			if err != nil {
-				return err
-			}
-		}
-		if config.localIP != 0 {
-			config.country = config.ipList.Find(uint64(config.localIP)).ShortName
+	CourierLogger.WithFields(logrus.Fields{
+		"address": config.localAddress,
+		"country": config.ruleTable.snapshot().country,
+	}).Debug("courier local country")
+	if config.Address != "" && config.ruleTable.snapshot().country == "" {
+		CourierLogger.WithField("discovery", config.Discovery).Warn("local country unknown, IP targets go through the proxy")
+	}
+	if config.ReloadInterval > 0 {
+		config.ruleTable.watch(config.ReloadInterval, config.Reload)
+	}
+	if config.Resolver != nil {
+		config.resolver, err = resolver.New(config.Resolver)
+		if err != nil {
+			return parser.Prefix("resolver", err)
 		}
 	}
-	dialerConfig, err := dialer.GetDialerConfig(config.Dialer)
+
+	config.dialer, err = dialer.New(config.Dialer)
 	if err != nil {
-		return err
+		return parser.Prefix("dialer", err)
 	}
-	err = dialerConfig.Init()
-	if err != nil {
-		return err
+	config.proxyDialer = config.dialer
+	if config.ProxyDialer != nil {
+		config.proxyDialer, err = dialer.New(config.ProxyDialer)
+		if err != nil {
+			return parser.Prefix("proxy_dialer", err)
+		}
 	}
-	config.dialer, err = dialerConfig.New()
-	if err != nil {
-		return err
+	if warmer, ok := config.proxyDialer.(dialer.Warmer); ok && config.Address != "" {
+		warmer.Warm(config.Network, config.Address)
 	}
 	return nil
 }
@@ -187,74 +174,243 @@ func (config *CourierConfig) Clone() Config {
 		Address:config.Address,
 		IPv4:config.IPv4,
 		IPv6:config.IPv6,
+		Country:config.Country,
+		Discovery:config.Discovery,
+		DiscoveryURL:config.DiscoveryURL,
+		STUNServer:config.STUNServer,
+		DiscoveryTimeout:config.DiscoveryTimeout,
+		Domains:config.Domains,
+		ReloadInterval:config.ReloadInterval,
+		Username:config.Username,
+		Password:config.Password,
+		HTTP:config.HTTP,
+		Sniff:config.Sniff,
+		SniffTimeout:config.SniffTimeout,
+		SniffPorts:config.SniffPorts,
+		IdleTimeout:config.IdleTimeout,
+		Resolver:config.Resolver,
 		Dialer:config.Dialer,
-		ipList: config.ipList,
+		ProxyDialer:config.ProxyDialer,
+		ruleTable: config.ruleTable,
 		localIP: config.localIP,
 		localAddress: config.localAddress,
-		country : config.country,
+		resolver: config.resolver,
 		dialer : config.dialer,
+		proxyDialer: config.proxyDialer,
+	}
+}
+
+func (config *CourierConfig) Route(addr *socks5.Address, host string) (string, string) {
+	snapshot := config.ruleTable.snapshot()
+	if host == "" {
+		host = addr.Domain
+	}
+	if host != "" {
+		if rule, ok := snapshot.domains.Match(host); ok {
+			if config.Address == "" {
+				return "direct", "domain:" + rule.Suffix
+			}
+			return rule.Action, "domain:" + rule.Suffix
+		}
+	}
+	if config.Address == "" {
+		return "direct", "no-proxy"
+	}
+	if addr.Domain != "" {
+		return "proxy", "domain"
+	}
+	remoteUIP := IPToUint64(addr.IP)
+	if remoteUIP == 0 {
+		return "direct", "invalid-ip"
+	}
+	seg := snapshot.ips.Find(remoteUIP)
+	if seg.ShortName == snapshot.country {
+		return "direct", "country:" + seg.ShortName
+	}
+	return "proxy", "country:" + seg.ShortName
+}
+
+func (config *CourierConfig) sniffPort(port uint16) bool {
+	for _, p := range config.SniffPorts {
+		if p == int(port) {
+			return true
+		}
 	}
+	return false
 }
 
-func (config *CourierConfig) Direct(conn net.Conn, remoteIP net.IP, remotePort uint16) (net.Conn, error) {
-	address := fmt.Sprintf("%s:%d", remoteIP.String(), remotePort)
-	remoteConn, err := config.dialer.Dial("tcp", address)
+func (config *CourierConfig) resolve(ctx context.Context, addr *socks5.Address) *socks5.Address {
+	if addr.Domain == "" || config.resolver == nil {
+		return addr
+	}
+	if _, ok := config.ruleTable.snapshot().domains.Match(addr.Domain); ok {
+		return addr
+	}
+	ips, err := config.resolver.LookupIP(ctx, "ip", addr.Domain)
+	if err != nil || len(ips) == 0 {
+		CourierLogger.WithError(err).WithField("domain", addr.Domain).Debug("courier resolve failed")
+		return addr
+	}
+	return &socks5.Address{IP: ips[0], Port: addr.Port}
+}
+
+func (config *CourierConfig) Direct(ctx context.Context, addr *socks5.Address) (net.Conn, *socks5.Address, error) {
+	remoteConn, err := config.dialer.DialContext(ctx, "tcp", addr.String())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	err = socks5.EncodeBindAddress(conn, remoteConn.RemoteAddr().String())
+	bind, err := socks5.ParseAddress(remoteConn.RemoteAddr().String())
 	if err != nil {
 		remoteConn.Close()
-		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
-	go socks5.Copy(remoteConn, conn)
-	go socks5.Copy(conn, remoteConn)
-	return remoteConn, nil
+	return remoteConn, bind, nil
 }
 
-func (config *CourierConfig) Proxy(conn net.Conn, remoteIP net.IP, remotePort uint16) (net.Conn, error) {
-	proxyConn, err := config.dialer.Dial(config.Network, config.Address)
+func (config *CourierConfig) Proxy(ctx context.Context, addr *socks5.Address) (net.Conn, *socks5.Address, error) {
+	proxyConn, err := config.proxyDialer.DialContext(ctx, config.Network, config.Address)
 	if err != nil {
-		return nil, err
+		metrics.SetUpstream(config.Address, err)
+		return nil, nil, err
 	}
-	bindIP, bindPort, err := socks5.Socks5Client(proxyConn, remoteIP, remotePort)
-	if err != nil {
-		return nil, err
+	metrics.SetUpstream(config.Address, nil)
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+		defer proxyConn.SetDeadline(time.Time{})
 	}
-	err = socks5.EncodeIPAndPort(conn, bindIP, bindPort)
+	bind, err := socks5.Socks5ClientUser(proxyConn, addr, config.Username, config.Password)
 	if err != nil {
 		proxyConn.Close()
-		conn.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	return proxyConn, bind, nil
+}
+
+func (config *CourierConfig) decode(conn net.Conn) (net.Conn, string, *socks5.Address, []byte, error) {
+	if !config.HTTP {
+		addr, err := socks5.Decode(conn)
+		return conn, "socks5", addr, nil, err
+	}
+	buffered := &bufferedConn{conn, bufio.NewReader(conn)}
+	head, err := buffered.reader.Peek(1)
+	if err != nil {
+		return nil, "", nil, nil, err
+	}
+	if head[0] == 5 {
+		addr, err := socks5.Decode(buffered)
+		return buffered.unwrap(), "socks5", addr, nil, err
+	}
+	addr, payload, err := ReadHTTPProxyRequest(buffered.reader)
+	if err != nil {
+		conn.Write([]byte(httpBadRequest))
+		return nil, "", nil, nil, err
+	}
+	if payload == nil {
+		return buffered.unwrap(), "connect", addr, nil, nil
+	}
+	return buffered.unwrap(), "http", addr, payload, nil
+}
+
+func reply(conn net.Conn, proto string, bind *socks5.Address, err error) error {
+	switch proto {
+	case "socks5":
+		if err != nil {
+			return socks5.EncodeReply(conn, 1, &socks5.Address{})
+		}
+		return socks5.EncodeAddress(conn, bind)
+	case "connect":
+		if err != nil {
+			_, e := conn.Write([]byte(httpBadGateway))
+			return e
+		}
+		_, e := conn.Write([]byte(httpEstablished))
+		return e
+	default:
+		if err != nil {
+			_, e := conn.Write([]byte(httpBadGateway))
+			return e
+		}
+		return nil
 	}
-	go socks5.Copy(proxyConn, conn)
-	go socks5.Copy(conn, proxyConn)
-	return proxyConn, nil
 }
 
-func (config *CourierConfig) New(conn net.Conn) (net.Conn, error) {
-	remoteIP, remotePort, err := socks5.Decode(conn)
+func (config *CourierConfig) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	conn, proto, addr, payload, err := config.decode(conn)
 	if err != nil {
 		return nil, err
 	}
-	if config.Address == "" {
-		return config.Direct(conn, remoteIP, remotePort)
+	addr, release := socks5.RestoreFakeIP(addr)
+	defer release()
+
+	var host string
+	replied := false
+	if config.Sniff && addr.Domain == "" && proto != "http" && config.sniffPort(addr.Port) {
+		err = reply(conn, proto, &socks5.Address{IP: net.IPv4zero}, nil)
+		if err != nil {
+			return nil, err
+		}
+		replied = true
+		payload, host = Sniff(conn, config.SniffTimeout)
 	}
-	remoteUIP := IPToUint64(remoteIP)
-	if remoteUIP == 0 {
-		return config.Direct(conn, remoteIP, remotePort)
+
+	dialCtx, stop := dialer.WatchClient(ctx, conn)
+	resolved := config.resolve(dialCtx, addr)
+	outbound, rule := config.Route(resolved, host)
+	CourierLogger.WithFields(logrus.Fields{
+		"target": addr.String(),
+		"host": host,
+		"protocol": proto,
+		"outbound": outbound,
+		"rule": rule,
+	}).Debug("courier route")
+	metrics.Routes.WithLabelValues("courier", outbound, rule).Inc()
+
+	var remoteConn net.Conn
+	var bind *socks5.Address
+	if outbound == "direct" {
+		remoteConn, bind, err = config.Direct(dialCtx, resolved)
+	} else {
+		remoteConn, bind, err = config.Proxy(dialCtx, addr)
+	}
+	extra, watchErr := stop()
+	if err == nil && watchErr != nil {
+		remoteConn.Close()
+		return nil, watchErr
+	}
+	payload = append(payload, extra...)
+	if err != nil {
+		if !replied {
+			reply(conn, proto, nil, err)
+		}
+		return nil, err
+	}
+	if !replied {
+		err = reply(conn, proto, bind, nil)
+	}
+	if err == nil && len(payload) > 0 {
+		_, err = remoteConn.Write(payload)
+	}
+	if err != nil {
+		remoteConn.Close()
+		conn.Close()
+		return nil, err
 	}
-	seg := config.ipList.Find(remoteUIP)
-	if seg.ShortName == config.country {
-		return config.Direct(conn, remoteIP, remotePort)
+	target := addr.String()
+	if host != "" {
+		target = net.JoinHostPort(host, strconv.Itoa(int(addr.Port)))
 	}
-	return config.Proxy(conn, remoteIP, remotePort)
+	t := tunnel.New(ctx, "courier", outbound, target, conn, remoteConn)
+	t.IdleTimeout = config.IdleTimeout
+	t.Run(ctx)
+	return nil, nil
 }
 
 func init() {
 	config := &CourierConfig{
 		Network: "tcp",
+		Discovery: "none",
+		STUNServer: "stun.l.google.com:19302",
+		SniffPorts: []int{80, 443},
 	}
 	Register("courier", config)
 }
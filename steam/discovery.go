@@ -0,0 +1,151 @@
+package stream
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunMagicCookie      = 0x2112A442
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+)
+
+func DiscoverHTTP(url string, timeout time.Duration) (net.IP, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected discovery status " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	data := struct {
+		Origin string `json:"origin"`
+		IP     string `json:"ip"`
+	}{}
+	address := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &data); err == nil {
+		address = data.Origin
+		if address == "" {
+			address = data.IP
+		}
+	}
+	if index := strings.Index(address, ","); index >= 0 {
+		address = address[:index]
+	}
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return nil, errors.New("invalid discovery response")
+	}
+	return ip, nil
+}
+
+func DiscoverSTUN(server string, timeout time.Duration) (net.IP, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	_, err = rand.Read(request[8:20])
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+	if len(buf) < 20 || binary.BigEndian.Uint16(buf[0:]) != stunBindingResponse {
+		return nil, errors.New("unexpected stun response")
+	}
+	if string(buf[8:20]) != string(request[8:20]) {
+		return nil, errors.New("stun transaction mismatch")
+	}
+	length := int(binary.BigEndian.Uint16(buf[2:]))
+	if 20+length > len(buf) {
+		return nil, errors.New("truncated stun response")
+	}
+
+	var mapped net.IP
+	attributes := buf[20 : 20+length]
+	for len(attributes) >= 4 {
+		typ := binary.BigEndian.Uint16(attributes[0:])
+		size := int(binary.BigEndian.Uint16(attributes[2:]))
+		if 4+size > len(attributes) {
+			break
+		}
+		value := attributes[4 : 4+size]
+		switch typ {
+		case stunXorMappedAddress:
+			if ip := stunAddress(value, buf[4:20]); ip != nil {
+				return ip, nil
+			}
+		case stunMappedAddress:
+			mapped = stunAddress(value, nil)
+		}
+		padded := 4 + (size+3)&^3
+		if padded > len(attributes) {
+			padded = len(attributes)
+		}
+		attributes = attributes[padded:]
+	}
+	if mapped == nil {
+		return nil, errors.New("stun mapped address not found")
+	}
+	return mapped, nil
+}
+
+func stunAddress(value []byte, xor []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	var ip net.IP
+	switch value[1] {
+	case 1:
+		ip = make(net.IP, net.IPv4len)
+	case 2:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	if len(value) < 4+len(ip) {
+		return nil
+	}
+	copy(ip, value[4:])
+	for i := range ip {
+		if xor != nil {
+			ip[i] ^= xor[i]
+		}
+	}
+	return ip
+}
@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDiscoverHTTP(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"json origin", http.StatusOK, `{"origin": "203.0.113.7"}`, "203.0.113.7"},
+		{"json ip", http.StatusOK, `{"ip": "2001:db8::7"}`, "2001:db8::7"},
+		{"origin list", http.StatusOK, `{"origin": "203.0.113.7, 10.0.0.1"}`, "203.0.113.7"},
+		{"plain text", http.StatusOK, "203.0.113.8\n", "203.0.113.8"},
+		{"invalid address", http.StatusOK, "unknown", ""},
+		{"empty json", http.StatusOK, `{}`, ""},
+		{"bad status", http.StatusServiceUnavailable, "203.0.113.9", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.status)
+				w.Write([]byte(c.body))
+			}))
+			defer server.Close()
+			ip, err := DiscoverHTTP(server.URL, time.Second)
+			if c.want == "" {
+				if err == nil {
+					t.Fatalf("got %s, want an error", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != c.want {
+				t.Fatalf("got %s, want %s", ip, c.want)
+			}
+		})
+	}
+}
+
+func stunAttribute(typ uint16, value []byte) []byte {
+	attr := make([]byte, 4, 4+len(value)+3)
+	binary.BigEndian.PutUint16(attr[0:], typ)
+	binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+	attr = append(attr, value...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+func stunValue(ip net.IP, xor []byte) []byte {
+	family := byte(1)
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else {
+		family = 2
+	}
+	value := append([]byte{0, family, 0, 0}, ip...)
+	for i := range ip {
+		if xor != nil {
+			value[4+i] ^= xor[i]
+		}
+	}
+	return value
+}
+
+func serveSTUN(t *testing.T, respond func(request []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(respond(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func stunResponse(request []byte, length int, attributes ...[]byte) []byte {
+	response := make([]byte, 20)
+	binary.BigEndian.PutUint16(response[0:], stunBindingResponse)
+	copy(response[4:], request[4:20])
+	for _, attr := range attributes {
+		response = append(response, attr...)
+	}
+	if length < 0 {
+		length = len(response) - 20
+	}
+	binary.BigEndian.PutUint16(response[2:], uint16(length))
+	return response
+}
+
+func TestDiscoverSTUN(t *testing.T) {
+	cases := []struct {
+		name    string
+		respond func(request []byte) []byte
+		want    string
+	}{
+		{"xor mapped ipv4", func(request []byte) []byte {
+			return stunResponse(request, -1, stunAttribute(stunXorMappedAddress, stunValue(net.ParseIP("198.51.100.1"), request[4:20])))
+		}, "198.51.100.1"},
+		{"xor mapped ipv6", func(request []byte) []byte {
+			return stunResponse(request, -1, stunAttribute(stunXorMappedAddress, stunValue(net.ParseIP("2001:db8::1"), request[4:20])))
+		}, "2001:db8::1"},
+		{"mapped address", func(request []byte) []byte {
+			return stunResponse(request, -1, stunAttribute(stunMappedAddress, stunValue(net.ParseIP("198.51.100.2"), nil)))
+		}, "198.51.100.2"},
+		{"xor mapped after a padded attribute", func(request []byte) []byte {
+			return stunResponse(request, -1,
+				stunAttribute(0x8022, []byte("abcde")),
+				stunAttribute(stunXorMappedAddress, stunValue(net.ParseIP("198.51.100.3"), request[4:20])))
+		}, "198.51.100.3"},
+		{"unpadded last attribute", func(request []byte) []byte {
+			response := stunResponse(request, -1,
+				stunAttribute(stunMappedAddress, stunValue(net.ParseIP("198.51.100.4"), nil)),
+				stunAttribute(0x8022, []byte("a")))
+			binary.BigEndian.PutUint16(response[2:], uint16(len(response)-20-3))
+			return response[:len(response)-3]
+		}, "198.51.100.4"},
+		{"no address", func(request []byte) []byte {
+			return stunResponse(request, -1, stunAttribute(0x8022, []byte("test")))
+		}, ""},
+		{"truncated", func(request []byte) []byte {
+			return stunResponse(request, 64, stunAttribute(stunMappedAddress, stunValue(net.ParseIP("198.51.100.5"), nil)))
+		}, ""},
+		{"transaction mismatch", func(request []byte) []byte {
+			response := stunResponse(request, -1, stunAttribute(stunMappedAddress, stunValue(net.ParseIP("198.51.100.6"), nil)))
+			response[19] ^= 0xff
+			return response
+		}, ""},
+		{"not a binding response", func(request []byte) []byte {
+			return []byte("HTTP/1.1 400 Bad Request\r\n\r\n")
+		}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, err := DiscoverSTUN(serveSTUN(t, c.respond), time.Second)
+			if c.want == "" {
+				if err == nil {
+					t.Fatalf("got %s, want an error", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != c.want {
+				t.Fatalf("got %s, want %s", ip, c.want)
+			}
+		})
+	}
+}
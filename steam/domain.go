@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+)
+
+type DomainRule struct {
+	Suffix string
+	Action string
+}
+
+type DomainList map[string]DomainRule
+
+func LoadDomainList(name string) (DomainList, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := DomainList{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 2 {
+			return nil, errors.New("invalid domain rule \"" + text + "\" in " + name)
+		}
+		suffix := strings.Trim(strings.ToLower(strings.TrimSpace(fields[0])), ".")
+		action := strings.ToLower(strings.TrimSpace(fields[1]))
+		if suffix == "" || (action != "direct" && action != "proxy") {
+			return nil, errors.New("invalid domain rule \"" + text + "\" in " + name)
+		}
+		list[suffix] = DomainRule{Suffix: suffix, Action: action}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (list DomainList) Match(host string) (DomainRule, bool) {
+	host = strings.Trim(strings.ToLower(host), ".")
+	for host != "" {
+		if rule, ok := list[host]; ok {
+			return rule, true
+		}
+		index := strings.Index(host, ".")
+		if index < 0 {
+			break
+		}
+		host = host[index+1:]
+	}
+	return DomainRule{}, false
+}
@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gchange/subsurface-stream/socks5"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	httpEstablished = "HTTP/1.1 200 Connection established\r\n\r\n"
+	httpBadRequest = "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+	httpBadGateway = "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+)
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (conn *bufferedConn) unwrap() net.Conn {
+	if conn.reader.Buffered() == 0 {
+		return conn.Conn
+	}
+	return conn
+}
+
+func ReadHTTPProxyRequest(reader *bufio.Reader) (*socks5.Address, []byte, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.Method == http.MethodConnect {
+		addr, err := socks5.ParseAddress(req.Host)
+		return addr, nil, err
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return nil, nil, errors.New("not a proxy request " + req.RequestURI)
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	addr, err := socks5.ParseAddress(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	} else if req.ContentLength > 0 && req.Header.Get("Content-Length") == "" {
+		req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	err = req.Header.Write(&buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf.WriteString("\r\n")
+	return addr, buf.Bytes(), nil
+}
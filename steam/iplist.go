@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+)
+
+type IPSegment struct {
+	Start     uint64
+	End       uint64
+	ShortName string
+	Name      string
+}
+
+type IPList []IPSegment
+
+func IPToUint64(ip net.IP) uint64 {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return uint64(ipv4[0])<<24 + uint64(ipv4[1])<<16 + uint64(ipv4[2])<<8 + uint64(ipv4[3])
+	} else if ipv6 := ip.To16(); ipv6 != nil {
+		return uint64(ipv6[0])<<56 + uint64(ipv6[1])<<48 + uint64(ipv6[2])<<40 + uint64(ipv6[3])<<32 + uint64(ipv6[4])<<24 + uint64(ipv6[5])<<16 + uint64(ipv6[6])<<8 + uint64(ipv6[7])
+	} else {
+		return 0
+	}
+}
+
+func (ipList IPList) find(n uint64) int {
+	listLen := len(ipList)
+	k := sort.Search(listLen, func(i int) bool {
+		return ipList[i].End >= n
+	})
+	if k < listLen && ipList[k].Start <= n {
+		return k
+	}
+	return listLen
+}
+
+func (ipList IPList) Find(n uint64) IPSegment {
+	index := ipList.find(n)
+	if index == len(ipList) {
+		return IPSegment{
+			Start:     n,
+			End:       n,
+			ShortName: "-",
+			Name:      "-",
+		}
+	}
+	return ipList[index]
+}
+
+func LoadIPList(name string, list IPList) (IPList, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != 4 {
+			continue
+		}
+		start, err := strconv.ParseUint(record[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(record[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if start > end {
+			return nil, errors.New("invalid ip segment " + record[0] + "-" + record[1] + " in " + name)
+		}
+		list = append(list, IPSegment{
+			Start:     start,
+			End:       end,
+			ShortName: record[2],
+			Name:      record[3],
+		})
+		count++
+	}
+	if count == 0 {
+		return nil, errors.New("no ip segment found in " + name)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Start < list[j].Start
+	})
+	return list, nil
+}
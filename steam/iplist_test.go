@@ -0,0 +1,28 @@
+package stream
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPToUint64(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want uint64
+	}{
+		{"1.2.3.4", 0x01020304},
+		{"255.255.255.255", 0xffffffff},
+		{"2001:db8:1234:5678::1", 0x20010db812345678},
+		{"2400:cb00:ff:1::", 0x2400cb0000ff0001},
+		{"::ffff:10.0.0.1", 0x0a000001},
+		{"::", 0},
+	}
+	for _, c := range cases {
+		if got := IPToUint64(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("IPToUint64(%s) = %#x, want %#x", c.ip, got, c.want)
+		}
+	}
+	if got := IPToUint64(nil); got != 0 {
+		t.Errorf("IPToUint64(nil) = %#x, want 0", got)
+	}
+}
@@ -0,0 +1,124 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type MuxConfig struct {
+	KeepAlive time.Duration `subsurface:"keep_alive" default:"30s" description:"interval of the keep-alive pings on each session"`
+	Configs []map[string]interface{} `subsurface:"config" schema:"stream" description:"stream chain applied to each multiplexed stream"`
+	streams []Config
+}
+
+func (config *MuxConfig) Init() error {
+	if config.KeepAlive < 0 {
+		return errors.New("invalid keep alive interval")
+	}
+	if len(config.Configs) == 0 {
+		return errors.New("mux stream chain not found")
+	}
+	var errs parser.Errors
+	config.streams = make([]Config, 0, len(config.Configs))
+	for i, m := range config.Configs {
+		s, err := GetStreamConfig(m)
+		if err == nil {
+			err = s.Init()
+		}
+		if err != nil {
+			errs.Add(parser.Prefix("config["+strconv.Itoa(i)+"]", err))
+			continue
+		}
+		config.streams = append(config.streams, s)
+	}
+	if len(errs) > 0 {
+		config.Close()
+		return errs.Err()
+	}
+	return nil
+}
+
+func (config *MuxConfig) Clone() Config {
+	return &MuxConfig{
+		KeepAlive: config.KeepAlive,
+		Configs: config.Configs,
+		streams: config.streams,
+	}
+}
+
+func (config *MuxConfig) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Time{})
+	session, err := yamux.Server(conn, dialer.MuxSessionConfig(config.KeepAlive))
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if session.IsClosed() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		go config.serve(ctx, stream)
+	}
+}
+
+func (config *MuxConfig) serve(ctx context.Context, conn net.Conn) {
+	for _, s := range config.streams {
+		next, err := s.New(ctx, conn)
+		if err != nil {
+			logrus.WithError(err).WithField("source", conn.RemoteAddr().String()).Debug("mux stream failed")
+			conn.Close()
+			return
+		}
+		if next == nil {
+			return
+		}
+		conn = next
+	}
+}
+
+func (config *MuxConfig) Reload() error {
+	var err error
+	for _, s := range config.streams {
+		if reloader, ok := s.(Reloader); ok {
+			if e := reloader.Reload(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (config *MuxConfig) Close() error {
+	var err error
+	for _, s := range config.streams {
+		if closer, ok := s.(io.Closer); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func init() {
+	Register("mux", &MuxConfig{})
+}
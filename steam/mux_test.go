@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/dialer"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type echoConfig struct{}
+
+func (config *echoConfig) Init() error {
+	return nil
+}
+
+func (config *echoConfig) Clone() Config {
+	return &echoConfig{}
+}
+
+func (config *echoConfig) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	defer conn.Close()
+	_, err := io.Copy(conn, conn)
+	return nil, err
+}
+
+func init() {
+	Register("echo", &echoConfig{})
+}
+
+func TestWebSocketMux(t *testing.T) {
+	ws, err := GetStreamConfig(map[string]interface{}{"name": "websocket", "path": "/tunnel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := GetStreamConfig(map[string]interface{}{
+		"name":   "mux",
+		"config": []interface{}{map[string]interface{}{"name": "echo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Config{ws, mux} {
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				next, err := ws.New(context.Background(), conn)
+				if err != nil {
+					return
+				}
+				mux.New(context.Background(), next)
+			}()
+		}
+	}()
+
+	config, err := dialer.GetDialerConfig(map[string]interface{}{
+		"name": "mux",
+		"dialer": map[string]interface{}{
+			"name":   "websocket",
+			"path":   "/tunnel",
+			"dialer": map[string]interface{}{"name": "direct"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Init(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := config.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.(io.Closer).Close()
+
+	for _, msg := range []string{"first", "second", "third"} {
+		conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Fatalf("echo %q, want %q", buf, msg)
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("%d transport connections, want 1", n)
+	}
+
+	wrong, err := dialer.GetDialerConfig(map[string]interface{}{
+		"name":   "websocket",
+		"path":   "/other",
+		"dialer": map[string]interface{}{"name": "direct"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrong.Init(); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := wrong.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wd.DialContext(context.Background(), "tcp", l.Addr().String()); err == nil || err.Error() != "websocket upgrade failed: 404 Not Found" {
+		t.Fatalf("got error %v, want a 404 upgrade failure", err)
+	}
+}
@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ruleSnapshot struct {
+	ips     IPList
+	domains DomainList
+	country string
+}
+
+type ruleTable struct {
+	value      atomic.Value
+	lock       sync.Mutex
+	ipFiles    []string
+	domainFile string
+	modTime    map[string]time.Time
+	ticker     *time.Ticker
+	done       chan struct{}
+}
+
+func newRuleTable(domainFile string, ipFiles ...string) *ruleTable {
+	table := &ruleTable{
+		domainFile: domainFile,
+		modTime:    make(map[string]time.Time, len(ipFiles)+1),
+	}
+	for _, name := range ipFiles {
+		if name != "" {
+			table.ipFiles = append(table.ipFiles, name)
+		}
+	}
+	table.value.Store(&ruleSnapshot{ips: IPList{}, domains: DomainList{}})
+	return table
+}
+
+func (table *ruleTable) files() []string {
+	if table.domainFile == "" {
+		return table.ipFiles
+	}
+	return append(table.ipFiles[:len(table.ipFiles):len(table.ipFiles)], table.domainFile)
+}
+
+func (table *ruleTable) reload(country func(IPList) string) error {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	for _, name := range table.files() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		table.modTime[name] = info.ModTime()
+	}
+
+	ips := make(IPList, 0, 1024)
+	for _, name := range table.ipFiles {
+		var err error
+		ips, err = LoadIPList(name, ips)
+		if err != nil {
+			return err
+		}
+	}
+	domains := DomainList{}
+	if table.domainFile != "" {
+		var err error
+		domains, err = LoadDomainList(table.domainFile)
+		if err != nil {
+			return err
+		}
+	}
+	table.value.Store(&ruleSnapshot{ips: ips, domains: domains, country: country(ips)})
+	return nil
+}
+
+func (table *ruleTable) snapshot() *ruleSnapshot {
+	return table.value.Load().(*ruleSnapshot)
+}
+
+func (table *ruleTable) changed() bool {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	for _, name := range table.files() {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(table.modTime[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (table *ruleTable) watch(interval time.Duration, reload func() error) {
+	t, done := time.NewTicker(interval), make(chan struct{})
+	table.lock.Lock()
+	table.ticker, table.done = t, done
+	table.lock.Unlock()
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				if !table.changed() {
+					continue
+				}
+				reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (table *ruleTable) close() {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.ticker != nil {
+		table.ticker.Stop()
+		close(table.done)
+		table.ticker, table.done = nil, nil
+	}
+}
@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleTableCloseDuringReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "ipv4.csv")
+	if err := ioutil.WriteFile(name, []byte("1,2,CN,China\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	country := func(IPList) string { return "CN" }
+	table := newRuleTable("", name)
+	if err := table.reload(country); err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	table.watch(time.Millisecond, func() error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return table.reload(country)
+	})
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not triggered")
+	}
+	table.close()
+	close(release)
+	table.close()
+	if got := len(table.snapshot().ips); got != 1 {
+		t.Fatalf("got %d segments, want 1", got)
+	}
+}
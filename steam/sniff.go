@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+const sniffBufferSize = 8192
+
+func Sniff(conn net.Conn, timeout time.Duration) ([]byte, string) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, ""
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, sniffBufferSize)
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if host, done := sniffHost(buf[:n]); done {
+			return buf[:n], host
+		}
+		if err != nil {
+			break
+		}
+	}
+	return buf[:n], ""
+}
+
+func sniffHost(buf []byte) (string, bool) {
+	if len(buf) == 0 {
+		return "", false
+	}
+	if buf[0] == 0x16 {
+		return SniffTLS(buf)
+	}
+	return SniffHTTP(buf)
+}
+
+func SniffTLS(buf []byte) (string, bool) {
+	var hello []byte
+	for {
+		if len(buf) < 5 {
+			return "", false
+		}
+		if buf[0] != 0x16 || buf[1] != 3 {
+			return "", true
+		}
+		recordLen := int(binary.BigEndian.Uint16(buf[3:5]))
+		if len(buf) < 5+recordLen {
+			return "", false
+		}
+		hello = append(hello, buf[5:5+recordLen]...)
+		buf = buf[5+recordLen:]
+		if len(hello) < 4 {
+			continue
+		}
+		if hello[0] != 1 {
+			return "", true
+		}
+		helloLen := int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3])
+		if helloLen <= len(hello)-4 {
+			hello = hello[4 : 4+helloLen]
+			break
+		}
+		if 4+helloLen > sniffBufferSize {
+			return "", true
+		}
+	}
+
+	if len(hello) < 34 {
+		return "", true
+	}
+	hello = hello[34:]
+	for _, size := range []int{1, 2, 1} {
+		if len(hello) < size {
+			return "", true
+		}
+		n := int(hello[0])
+		if size == 2 {
+			n = int(binary.BigEndian.Uint16(hello))
+		}
+		if len(hello) < size+n {
+			return "", true
+		}
+		hello = hello[size+n:]
+	}
+
+	if len(hello) < 2 {
+		return "", true
+	}
+	extensions := hello[2:]
+	if n := int(binary.BigEndian.Uint16(hello)); n < len(extensions) {
+		extensions = extensions[:n]
+	}
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions[0:])
+		size := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+size {
+			break
+		}
+		data := extensions[4 : 4+size]
+		extensions = extensions[4+size:]
+		if typ != 0 || len(data) < 2 {
+			continue
+		}
+		names := data[2:]
+		for len(names) >= 3 {
+			nameLen := int(binary.BigEndian.Uint16(names[1:]))
+			if len(names) < 3+nameLen {
+				break
+			}
+			if names[0] == 0 {
+				return string(names[3 : 3+nameLen]), true
+			}
+			names = names[3+nameLen:]
+		}
+	}
+	return "", true
+}
+
+func SniffHTTP(buf []byte) (string, bool) {
+	index := bytes.Index(buf, []byte("\r\n"))
+	if index < 0 {
+		if len(buf) > 16 && bytes.IndexByte(buf, ' ') < 0 {
+			return "", true
+		}
+		return "", false
+	}
+	if !bytes.Contains(buf[:index], []byte(" HTTP/1.")) {
+		return "", true
+	}
+	headers := buf[index+2:]
+	for {
+		index = bytes.Index(headers, []byte("\r\n"))
+		if index < 0 {
+			return "", false
+		}
+		if index == 0 {
+			return "", true
+		}
+		line := string(headers[:index])
+		headers = headers[index+2:]
+		colon := strings.Index(line, ":")
+		if colon < 0 || !strings.EqualFold(strings.TrimSpace(line[:colon]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(line[colon+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]"), true
+	}
+}
@@ -0,0 +1,127 @@
+package stream
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func fragmentRecords(hello []byte, size int) []byte {
+	var records []byte
+	payload := hello[5:]
+	for len(payload) > 0 {
+		n := size
+		if n > len(payload) {
+			n = len(payload)
+		}
+		records = append(records, 0x16, 3, 1, byte(n>>8), byte(n))
+		records = append(records, payload[:n]...)
+		payload = payload[n:]
+	}
+	return records
+}
+
+func TestSniffTLS(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	noSNI := clientHello(t, "")
+	serverHello := append([]byte{}, hello...)
+	serverHello[5] = 2
+	cases := []struct {
+		name string
+		buf  []byte
+		host string
+		done bool
+	}{
+		{"client hello", hello, "example.com", true},
+		{"record header only", hello[:5], "", false},
+		{"truncated record", hello[:len(hello)-1], "", false},
+		{"fragmented records", fragmentRecords(hello, 64), "example.com", true},
+		{"first fragment only", fragmentRecords(hello, 64)[:69], "", false},
+		{"fragmented handshake header", fragmentRecords(hello, 2), "example.com", true},
+		{"without server name", noSNI, "", true},
+		{"server hello", serverHello, "", true},
+		{"not a handshake record", append([]byte{0x17}, hello[1:]...), "", true},
+		{"ssl2 version", []byte{0x16, 2, 0, 0, 0}, "", true},
+		{"oversized handshake", []byte{0x16, 3, 1, 0, 4, 1, 0xff, 0xff, 0xff}, "", true},
+		{"short hello body", []byte{0x16, 3, 1, 0, 6, 1, 0, 0, 2, 3, 3}, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host, done := SniffTLS(c.buf)
+			if host != c.host || done != c.done {
+				t.Fatalf("got (%q, %v), want (%q, %v)", host, done, c.host, c.done)
+			}
+		})
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	cases := []struct {
+		name string
+		buf  string
+		host string
+		done bool
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", true},
+		{"host with port", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com", true},
+		{"ipv6 host", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "2001:db8::1", true},
+		{"header case and spaces", "GET / HTTP/1.0\r\nAccept: */*\r\nhOST :  example.org \r\n\r\n", "example.org", true},
+		{"empty host", "GET / HTTP/1.1\r\nHost:\r\n\r\n", "", true},
+		{"missing host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", "", true},
+		{"header without colon", "GET / HTTP/1.1\r\nbroken\r\nHost: example.com\r\n\r\n", "example.com", true},
+		{"incomplete headers", "GET / HTTP/1.1\r\nAccept: */*\r\n", "", false},
+		{"incomplete request line", "GET / HT", "", false},
+		{"not http", "SSH-2.0-OpenSSH_9.0\r\n", "", true},
+		{"binary without line break", "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host, done := SniffHTTP([]byte(c.buf))
+			if host != c.host || done != c.done {
+				t.Fatalf("got (%q, %v), want (%q, %v)", host, done, c.host, c.done)
+			}
+		})
+	}
+}
+
+func TestSniffFragmentedReads(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		for i := 0; i < len(hello); i += 7 {
+			end := i + 7
+			if end > len(hello) {
+				end = len(hello)
+			}
+			if _, err := client.Write(hello[i:end]); err != nil {
+				return
+			}
+		}
+	}()
+	payload, host := Sniff(server, time.Second)
+	if host != "example.com" || len(payload) != len(hello) {
+		t.Fatalf("got (%d bytes, %q), want (%d bytes, %q)", len(payload), host, len(hello), "example.com")
+	}
+}
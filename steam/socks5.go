@@ -1,48 +1,74 @@
 package stream
 
 import (
+	"context"
+	"errors"
 	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/parser"
 	"github.com/gchange/subsurface-stream/socks5"
+	"github.com/gchange/subsurface-stream/tunnel"
+	"io"
 	"net"
+	"time"
 )
 
 type Socks5Config struct {
-	Network string `subsurface:"network"`
-	Address string `subsurface:"address"`
-	Dialer map[string]interface{} `subsurface:"dialer"`
+	Network string `subsurface:"network" description:"network of the upstream SOCKS5 proxy"`
+	Address string `subsurface:"address" validate:"address" description:"address of the upstream SOCKS5 proxy, empty serves requests directly"`
+	IdleTimeout time.Duration `subsurface:"idle_timeout" default:"5m" description:"close tunnels idle for this long"`
+	Users map[string]interface{} `subsurface:"users" schema:"values:string" description:"passwords by username, empty disables authentication"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer for outgoing connections"`
+	users map[string]string
 	dialer dialer.Dialer
 }
 
 func (config *Socks5Config) Init() error {
-	dialerConfig, err := dialer.GetDialerConfig(config.Dialer)
-	if err != nil {
-		return err
-	}
-	err = dialerConfig.Init()
-	if err != nil {
-		return err
+	var err error
+	config.users = make(map[string]string, len(config.Users))
+	for user, password := range config.Users {
+		p, ok := password.(string)
+		if !ok {
+			return errors.New("password of user " + user + " must be a string")
+		}
+		config.users[user] = p
 	}
-	config.dialer, err = dialerConfig.New()
-	if err != nil {
-		return err
-	}
-	return nil
+	config.dialer, err = dialer.New(config.Dialer)
+	return parser.Prefix("dialer", err)
 }
 
 func (config *Socks5Config) Clone() Config {
 	return &Socks5Config{
 		Network: config.Network,
 		Address:config.Address,
+		IdleTimeout: config.IdleTimeout,
+		Users: config.Users,
 		Dialer: config.Dialer,
+		users: config.users,
 		dialer:config.dialer,
 	}
 }
 
-func (config *Socks5Config) New(conn net.Conn) (net.Conn, error) {
+func (config *Socks5Config) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	var t *tunnel.Tunnel
+	var err error
 	if config.Address == "" {
-		return socks5.Socks5Server(conn, config.dialer)
+		t, err = socks5.Socks5Server(ctx, conn, config.dialer, config.users)
+	} else {
+		t, err = socks5.Socks5Proxy(ctx, conn, config.dialer, config.Network, config.Address, config.users)
 	}
-	return socks5.Socks5Proxy(conn, config.dialer, config.Network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+	t.IdleTimeout = config.IdleTimeout
+	t.Run(ctx)
+	return nil, nil
+}
+
+func (config *Socks5Config) Close() error {
+	if closer, ok := config.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
 func init() {
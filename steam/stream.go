@@ -1,10 +1,12 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"github.com/gchange/subsurface-stream/parser"
 	"net"
 	"reflect"
+	"sort"
 	"sync"
 )
 
@@ -16,7 +18,11 @@ var (
 type Config interface {
 	Init() error
 	Clone() Config
-	New(conn net.Conn) (net.Conn, error)
+	New(ctx context.Context, conn net.Conn) (net.Conn, error)
+}
+
+type Reloader interface {
+	Reload() error
 }
 
 func GetStreamConfig(config map[string]interface{}) (Config, error) {
@@ -31,13 +37,51 @@ func GetStreamConfig(config map[string]interface{}) (Config, error) {
 	defer lock.RUnlock()
 	if c, ok := pool[name]; ok {
 		nc := c.Clone()
-		err := parser.Unmarshal("subsurface", reflect.ValueOf(nc), config)
+		err := parser.Unmarshal("subsurface", reflect.ValueOf(nc), config, "name")
 		if err != nil {
 			return nil, err
 		}
 		return nc, nil
 	}
-	return nil, errors.New("config not found")
+	return nil, parser.UnknownName("stream", name, names())
+}
+
+func names() []string {
+	list := make([]string, 0, len(pool))
+	for name := range pool {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func Names() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return names()
+}
+
+func init() {
+	parser.RegisterKind("stream", "subsurface", prototype)
+}
+
+func prototype(name string) (interface{}, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if c, ok := pool[name]; ok {
+		return c.Clone(), true
+	}
+	return nil, false
+}
+
+func Configs() map[string]Config {
+	lock.RLock()
+	defer lock.RUnlock()
+	configs := make(map[string]Config, len(pool))
+	for name, config := range pool {
+		configs[name] = config.Clone()
+	}
+	return configs
 }
 
 func Register(name string, config Config) error {
@@ -1,23 +1,82 @@
 package stream
 
-import "net"
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/parser"
+	"github.com/gchange/subsurface-stream/socks5"
+	"github.com/gchange/subsurface-stream/tunnel"
+	"io"
+	"net"
+	"time"
+)
 
 type TCPConfig struct {
+	Network string `subsurface:"network" description:"network of the forward target"`
+	Address string `subsurface:"address" validate:"address" required:"true" description:"forward target address"`
+	IdleTimeout time.Duration `subsurface:"idle_timeout" default:"5m" description:"close tunnels idle for this long"`
+	Dialer map[string]interface{} `subsurface:"dialer" schema:"dialer" description:"dialer for outgoing connections"`
+	dialer dialer.Dialer
 }
 
 func (config *TCPConfig) Init() error {
+	var err error
+	config.dialer, err = dialer.New(config.Dialer)
+	if err != nil {
+		return parser.Prefix("dialer", err)
+	}
+	if warmer, ok := config.dialer.(dialer.Warmer); ok {
+		warmer.Warm(config.Network, config.Address)
+	}
 	return nil
 }
 
 func (config *TCPConfig) Clone() Config {
-	return &TCPConfig{}
+	return &TCPConfig{
+		Network: config.Network,
+		Address: config.Address,
+		IdleTimeout: config.IdleTimeout,
+		Dialer: config.Dialer,
+		dialer: config.dialer,
+	}
 }
 
-func (config *TCPConfig) New(conn net.Conn) (net.Conn, error) {
+func (config *TCPConfig) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	address := config.Address
+	if addr, err := socks5.ParseAddress(address); err == nil {
+		restored, release := socks5.RestoreFakeIP(addr)
+		defer release()
+		address = restored.String()
+	}
+	dialCtx, stop := dialer.WatchClient(ctx, conn)
+	remoteConn, err := config.dialer.DialContext(dialCtx, config.Network, address)
+	extra, watchErr := stop()
+	if err != nil {
+		return nil, err
+	}
+	if watchErr == nil && len(extra) > 0 {
+		_, watchErr = remoteConn.Write(extra)
+	}
+	if watchErr != nil {
+		remoteConn.Close()
+		return nil, watchErr
+	}
+	t := tunnel.New(ctx, "tcp", "direct", address, conn, remoteConn)
+	t.IdleTimeout = config.IdleTimeout
+	t.Run(ctx)
 	return nil, nil
 }
 
+func (config *TCPConfig) Close() error {
+	if closer, ok := config.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func init() {
-	config := &TCPConfig{}
+	config := &TCPConfig{
+		Network: "tcp",
+	}
 	Register("tcp", config)
 }
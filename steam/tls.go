@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+)
+
+type TLSConfig struct {
+	Cert string `subsurface:"cert" description:"PEM certificate file, reloaded on SIGHUP"`
+	Key string `subsurface:"key" description:"PEM key file"`
+	ClientCA string `subsurface:"client_ca" description:"PEM CA file, when set clients must present a certificate"`
+	certificate *atomic.Value
+	tlsConfig *tls.Config
+}
+
+func (config *TLSConfig) loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return err
+	}
+	config.certificate.Store(&cert)
+	return nil
+}
+
+func (config *TLSConfig) Init() error {
+	if config.Cert == "" || config.Key == "" {
+		return errors.New("tls cert and key not found")
+	}
+	config.certificate = &atomic.Value{}
+	err := config.loadCertificate()
+	if err != nil {
+		return err
+	}
+	certificate := config.certificate
+	config.tlsConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificate.Load().(*tls.Certificate), nil
+		},
+	}
+	if config.ClientCA != "" {
+		buf, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return errors.New("no certificate found in " + config.ClientCA)
+		}
+		config.tlsConfig.ClientCAs = pool
+		config.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+func (config *TLSConfig) Reload() error {
+	return config.loadCertificate()
+}
+
+func (config *TLSConfig) Clone() Config {
+	return &TLSConfig{
+		Cert: config.Cert,
+		Key: config.Key,
+		ClientCA: config.ClientCA,
+		certificate: config.certificate,
+		tlsConfig: config.tlsConfig,
+	}
+}
+
+func (config *TLSConfig) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, config.tlsConfig)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func init() {
+	Register("tls", &TLSConfig{})
+}
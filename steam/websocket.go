@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type WebSocketConfig struct {
+	Path string `subsurface:"path" default:"/" description:"request path accepted for the WebSocket upgrade"`
+	upgrader *websocket.Upgrader
+}
+
+type hijackWriter struct {
+	conn net.Conn
+	reader *bufio.Reader
+	header http.Header
+	wroteHeader bool
+}
+
+func (w *hijackWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *hijackWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.header.Set("Connection", "close")
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	w.header.Write(w.conn)
+	w.conn.Write([]byte("\r\n"))
+}
+
+func (w *hijackWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.conn.Write(b)
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(w.reader, bufio.NewWriter(w.conn)), nil
+}
+
+func (config *WebSocketConfig) Init() error {
+	if !strings.HasPrefix(config.Path, "/") {
+		return errors.New("websocket path must start with /")
+	}
+	config.upgrader = &websocket.Upgrader{}
+	return nil
+}
+
+func (config *WebSocketConfig) Clone() Config {
+	return &WebSocketConfig{
+		Path: config.Path,
+		upgrader: config.upgrader,
+	}
+}
+
+func (config *WebSocketConfig) New(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Write([]byte(httpBadRequest))
+		return nil, err
+	}
+	w := &hijackWriter{conn: conn, reader: reader, header: http.Header{}}
+	if req.URL.Path != config.Path {
+		http.NotFound(w, req)
+		return nil, errors.New("websocket path " + req.URL.Path + " not found")
+	}
+	ws, err := config.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.WebSocketConn(ws), nil
+}
+
+func init() {
+	Register("websocket", &WebSocketConfig{})
+}
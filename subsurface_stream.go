@@ -1,92 +1,287 @@
 package subsurface_stream
 
 import (
-	"github.com/gchange/subsurface-stream/steam"
+	"context"
+	"errors"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/ratelimit"
+	"github.com/gchange/subsurface-stream/tunnel"
 	"github.com/sirupsen/logrus"
 	"net"
 	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+	drainInterval = 100 * time.Millisecond
 )
 
 type Config struct {
-	Network string `json:"network"`
-	Address string `json:"address"`
-	Configs []map[string]interface{} `json:"config"`
+	Network string `json:"network" description:"listen network"`
+	Address string `json:"address" validate:"address" description:"listen address"`
+	Configs []map[string]interface{} `json:"config" schema:"stream" description:"stream chain applied to each accepted connection"`
+	RateLimit *ratelimit.GroupConfig `json:"rate_limit" description:"bandwidth limits of the listener"`
+	MaxConnections int `json:"max_connections" description:"maximum concurrent connections, 0 is unlimited"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip" description:"maximum concurrent connections per source IP, 0 is unlimited"`
+	HandshakeTimeout time.Duration `json:"handshake_timeout" description:"deadline for the stream handshakes"`
+	DialTimeout time.Duration `json:"dial_timeout" default:"30s" description:"deadline for dialing the target of a connection"`
 }
 
 type SubsurfaceStream struct {
 	*Config
-	Streams []stream.Config
 	listener net.Listener
+	ctx context.Context
+	cancel context.CancelFunc
 	pool map[net.Conn]bool
 	lock sync.RWMutex
+	chain *Chain
+	sources map[string]int
+	tunnels *tunnel.Group
 }
 
 func (config *Config) New() (*SubsurfaceStream, error) {
-	var err error
-	streams := make([]stream.Config, len(config.Configs))
-	for i, m := range config.Configs {
-		streams[i], err = stream.GetStreamConfig(m)
-		if err != nil {
-			return nil, err
-		}
-		err = streams[i].Init()
-		if err != nil {
-			return nil, err
-		}
+	chain, err := config.NewChain()
+	if err != nil {
+		return nil, err
 	}
+	return config.Listen(chain)
+}
+
+func (config *Config) Listen(chain *Chain) (*SubsurfaceStream, error) {
 	listener, err := net.Listen(config.Network, config.Address)
 	if err != nil {
+		chain.Close()
 		return nil, err
 	}
+	tunnels := tunnel.NewGroup()
+	ctx, cancel := context.WithCancel(tunnel.WithGroup(context.Background(), tunnels))
 	return &SubsurfaceStream{
 		config,
-		streams,
 		listener,
+		ctx,
+		cancel,
 		make(map[net.Conn]bool, 0),
 		sync.RWMutex{},
+		chain,
+		make(map[string]int, 0),
+		tunnels,
 	}, nil
 }
 
-func (ss *SubsurfaceStream) accept(conn net.Conn) {
+func sourceIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (ss *SubsurfaceStream) acquire(conn net.Conn, ip string) (*Chain, string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.ctx.Err() != nil {
+		return nil, "closed"
+	}
+	chain := ss.chain
+	if chain.MaxConnections > 0 && len(ss.pool) >= chain.MaxConnections {
+		return nil, "max_connections"
+	}
+	if chain.MaxConnectionsPerIP > 0 && ss.sources[ip] >= chain.MaxConnectionsPerIP {
+		return nil, "max_connections_per_ip"
+	}
+	ss.pool[conn] = true
+	ss.sources[ip]++
+	chain.refs.Add(1)
+	return chain, ""
+}
+
+func (ss *SubsurfaceStream) release(conn net.Conn, ip string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	delete(ss.pool, conn)
+	if ss.sources[ip] <= 1 {
+		delete(ss.sources, ip)
+	} else {
+		ss.sources[ip]--
+	}
+}
+
+func (ss *SubsurfaceStream) accept(chain *Chain, conn net.Conn, ip string) {
 	var err error
+	defer chain.refs.Done()
+	defer ss.release(conn, ip)
 	defer func() {
 		if err != nil && conn != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"listener": ss.Address,
+				"source": conn.RemoteAddr().String(),
+			}).Debug("stream failed, close connection")
 			conn.Close()
 		}
 	}()
 
-	for _, stream := range ss.Streams {
-		conn, err = stream.New(conn)
-		if err != nil {
+	if chain.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(chain.HandshakeTimeout))
+	}
+	ctx, cancel := context.WithCancel(ss.ctx)
+	defer cancel()
+	ctx = dialer.WithMetadata(ctx, &dialer.Metadata{
+		Listener: ss.Address,
+		Source: conn.RemoteAddr(),
+		RateLimit: chain.rateLimit,
+		DialTimeout: chain.DialTimeout,
+	})
+	for _, stream := range chain.Streams {
+		var next net.Conn
+		next, err = stream.New(ctx, conn)
+		if err != nil || next == nil {
 			break
 		}
+		conn = next
 	}
 }
 
+func temporary(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func (ss *SubsurfaceStream) Run() {
+	var delay time.Duration
 	for {
 		conn, err := ss.listener.Accept()
 		if err != nil {
-			logrus.WithError(err).Debug("failed to accept connection")
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if temporary(err) {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				logrus.WithError(err).WithField("delay", delay.String()).Warn("failed to accept connection, retrying")
+				time.Sleep(delay)
+				continue
+			}
+			logrus.WithError(err).WithField("listener", ss.Address).Error("listener stopped")
+			return
+		}
+		delay = 0
+		metrics.Accepted.WithLabelValues(ss.Address).Inc()
+		ip := sourceIP(conn.RemoteAddr())
+		chain, reason := ss.acquire(conn, ip)
+		if reason != "" {
+			metrics.Rejected.WithLabelValues(ss.Address, reason).Inc()
+			logrus.WithFields(logrus.Fields{
+				"listener": ss.Address,
+				"source": conn.RemoteAddr().String(),
+				"reason": reason,
+			}).Debug("connection rejected")
+			conn.Close()
 			continue
 		}
-		go ss.accept(conn)
+		go ss.accept(chain, conn, ip)
+	}
+}
+
+func (ss *SubsurfaceStream) Chain() *Chain {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	return ss.chain
+}
+
+func (ss *SubsurfaceStream) Swap(chain *Chain) error {
+	if chain.Network != ss.Network || chain.Address != ss.Address {
+		return errors.New("chain listens on " + chain.Network + " " + chain.Address + " not " + ss.Network + " " + ss.Address)
+	}
+	ss.lock.Lock()
+	if ss.ctx.Err() != nil {
+		ss.lock.Unlock()
+		return errors.New("stream closed")
+	}
+	old := ss.chain
+	ss.chain = chain
+	ss.lock.Unlock()
+	go old.drain()
+	return nil
+}
+
+func (ss *SubsurfaceStream) Reload() error {
+	return ss.Chain().Reload()
+}
+
+func (ss *SubsurfaceStream) Connections() int {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	return len(ss.pool)
+}
+
+func (ss *SubsurfaceStream) Tunnels() []*tunnel.Tunnel {
+	return ss.tunnels.List()
+}
+
+func (ss *SubsurfaceStream) CloseListener() error {
+	err := ss.listener.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (ss *SubsurfaceStream) Shutdown(ctx context.Context) error {
+	if err := ss.CloseListener(); err != nil {
+		logrus.WithError(err).Debug("fail to close listener")
+	}
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for ss.Connections() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logrus.WithFields(logrus.Fields{
+				"listener": ss.Address,
+				"connections": ss.Connections(),
+			}).Warn("drain timeout, force close connections")
+			ss.Close()
+			return ctx.Err()
+		}
 	}
+	return ss.Close()
 }
 
 func (ss *SubsurfaceStream) Close() error {
 	ss.lock.Lock()
 	defer ss.lock.Unlock()
+	if ss.ctx.Err() != nil {
+		return nil
+	}
+	ss.cancel()
 	err := ss.listener.Close()
-	if err != nil {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		logrus.WithError(err).Debug("fail to close listener")
+	} else {
+		err = nil
 	}
+	ss.tunnels.Close("shutdown")
 	for conn := range ss.pool {
-		if e := conn.Close(); e != nil {
+		if e := conn.Close(); e != nil && !errors.Is(e, net.ErrClosed) {
 			logrus.WithError(e).Debug("fail to close pool connection")
 			err = e
 		}
 	}
-	ss.pool = nil
+	go ss.chain.drain()
 	return err
 }
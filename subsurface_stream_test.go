@@ -0,0 +1,32 @@
+package subsurface_stream
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestTemporary(t *testing.T) {
+	accept := func(err error) error {
+		return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", err)}
+	}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{accept(syscall.EMFILE), true},
+		{accept(syscall.ENFILE), true},
+		{accept(syscall.ENOBUFS), true},
+		{accept(os.ErrDeadlineExceeded), true},
+		{accept(syscall.EINVAL), false},
+		{net.ErrClosed, false},
+		{errors.New("accept failed"), false},
+	}
+	for _, c := range cases {
+		if got := temporary(c.err); got != c.want {
+			t.Errorf("temporary(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+)
+
+type groupKey struct{}
+
+type Group struct {
+	tunnels map[*Tunnel]struct{}
+	lock    sync.RWMutex
+}
+
+func NewGroup() *Group {
+	return &Group{
+		tunnels: make(map[*Tunnel]struct{}, 0),
+	}
+}
+
+func WithGroup(ctx context.Context, group *Group) context.Context {
+	return context.WithValue(ctx, groupKey{}, group)
+}
+
+func GroupFromContext(ctx context.Context) (*Group, bool) {
+	group, ok := ctx.Value(groupKey{}).(*Group)
+	return group, ok
+}
+
+func (group *Group) add(t *Tunnel) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	group.tunnels[t] = struct{}{}
+}
+
+func (group *Group) remove(t *Tunnel) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	delete(group.tunnels, t)
+}
+
+func (group *Group) Len() int {
+	group.lock.RLock()
+	defer group.lock.RUnlock()
+	return len(group.tunnels)
+}
+
+func (group *Group) List() []*Tunnel {
+	group.lock.RLock()
+	defer group.lock.RUnlock()
+	tunnels := make([]*Tunnel, 0, len(group.tunnels))
+	for t := range group.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+func (group *Group) Close(reason string) {
+	for _, t := range group.List() {
+		t.Close(reason)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func readable(conn *net.TCPConn) (int64, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int32
+	var buf [1]byte
+	err = raw.Read(func(fd uintptr) bool {
+		m, _, e := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		if e != nil || m == 0 {
+			return true
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+		if errno != 0 {
+			n = int32(m)
+		}
+		return true
+	})
+	return int64(n), err
+}
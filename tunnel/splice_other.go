@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"net"
+)
+
+func readable(conn *net.TCPConn) (int64, error) {
+	return spliceChunk, nil
+}
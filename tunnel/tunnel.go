@@ -0,0 +1,278 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/gchange/subsurface-stream/dialer"
+	"github.com/gchange/subsurface-stream/metrics"
+	"github.com/gchange/subsurface-stream/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const spliceChunk = 1 << 20
+
+var (
+	AccessLogger = logrus.StandardLogger()
+	nextID       uint64
+	bufferPool   = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, 32*1024)
+			return &buf
+		},
+	}
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type Tunnel struct {
+	ID          uint64
+	Listener    string
+	Source      string
+	Target      string
+	Stream      string
+	Outbound    string
+	Client      net.Conn
+	Upstream    net.Conn
+	Start       time.Time
+	IdleTimeout time.Duration
+	User        string
+	Limits      []*ratelimit.Limit
+	upload      int64
+	download    int64
+	active      int64
+	reason      string
+	reasonLock  sync.Mutex
+	closeOnce   sync.Once
+	onClose     []func()
+}
+
+func New(ctx context.Context, stream, outbound, target string, client, upstream net.Conn) *Tunnel {
+	t := &Tunnel{
+		ID:       atomic.AddUint64(&nextID, 1),
+		Target:   target,
+		Stream:   stream,
+		Outbound: outbound,
+		Client:   client,
+		Upstream: upstream,
+		Start:    time.Now(),
+	}
+	if metadata, ok := dialer.MetadataFromContext(ctx); ok {
+		t.Listener = metadata.Listener
+		t.User = metadata.User
+		t.Limits = metadata.RateLimit.Limits(metadata.User)
+		if metadata.Source != nil {
+			t.Source = metadata.Source.String()
+		}
+	} else if client.RemoteAddr() != nil {
+		t.Source = client.RemoteAddr().String()
+	}
+	return t
+}
+
+func (t *Tunnel) Upload() int64 {
+	return atomic.LoadInt64(&t.upload)
+}
+
+func (t *Tunnel) Download() int64 {
+	return atomic.LoadInt64(&t.download)
+}
+
+func (t *Tunnel) Reason() string {
+	t.reasonLock.Lock()
+	defer t.reasonLock.Unlock()
+	return t.reason
+}
+
+func (t *Tunnel) OnClose(f func()) {
+	t.onClose = append(t.onClose, f)
+}
+
+func (t *Tunnel) Run(ctx context.Context) {
+	defer func() {
+		for _, f := range t.onClose {
+			f()
+		}
+	}()
+	metrics.ActiveTunnels.WithLabelValues(t.Stream, t.Outbound).Inc()
+	defer metrics.ActiveTunnels.WithLabelValues(t.Stream, t.Outbound).Dec()
+	if group, ok := GroupFromContext(ctx); ok {
+		group.add(t)
+		defer group.remove(t)
+	}
+	atomic.StoreInt64(&t.active, time.Now().UnixNano())
+	t.Client.SetDeadline(time.Time{})
+	t.Upstream.SetDeadline(time.Time{})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Close("canceled")
+		case <-done:
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := t.copy(ctx, t.Upstream, t.Client, &t.upload, t.limiters(true), metrics.Bytes.WithLabelValues(t.Stream, t.Outbound, "out"))
+		t.halfClose(t.Upstream, "client", err)
+	}()
+	go func() {
+		defer wg.Done()
+		err := t.copy(ctx, t.Client, t.Upstream, &t.download, t.limiters(false), metrics.Bytes.WithLabelValues(t.Stream, t.Outbound, "in"))
+		t.halfClose(t.Client, "upstream", err)
+	}()
+	wg.Wait()
+	t.Close("done")
+
+	AccessLogger.WithFields(logrus.Fields{
+		"listener": t.Listener,
+		"source":   t.Source,
+		"user":     t.User,
+		"target":   t.Target,
+		"stream":   t.Stream,
+		"outbound": t.Outbound,
+		"upload":   t.Upload(),
+		"download": t.Download(),
+		"duration": time.Since(t.Start).String(),
+		"reason":   t.Reason(),
+	}).Info("tunnel closed")
+}
+
+func (t *Tunnel) setReason(reason string) {
+	t.reasonLock.Lock()
+	defer t.reasonLock.Unlock()
+	if t.reason == "" {
+		t.reason = reason
+	}
+}
+
+func (t *Tunnel) Close(reason string) {
+	t.setReason(reason)
+	t.closeOnce.Do(func() {
+		if err := t.Client.Close(); err != nil {
+			logrus.WithError(err).Debug("close tunnel client failed")
+		}
+		if err := t.Upstream.Close(); err != nil {
+			logrus.WithError(err).Debug("close tunnel upstream failed")
+		}
+	})
+}
+
+func (t *Tunnel) halfClose(dst net.Conn, side string, err error) {
+	if err != nil {
+		t.Close(side + " error: " + err.Error())
+		return
+	}
+	t.setReason(side + " closed")
+	if cw, ok := dst.(closeWriter); ok {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+	t.Close(side + " closed")
+}
+
+func (t *Tunnel) idle(err error) bool {
+	if t.IdleTimeout <= 0 {
+		return false
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&t.active))
+	return time.Since(last) < t.IdleTimeout
+}
+
+func (t *Tunnel) limiters(upload bool) []*ratelimit.Limiter {
+	limiters := make([]*ratelimit.Limiter, 0, len(t.Limits))
+	for _, limit := range t.Limits {
+		limiter := limit.Download
+		if upload {
+			limiter = limit.Upload
+		}
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return limiters
+}
+
+func chunkSize(size int64, limiters []*ratelimit.Limiter) int64 {
+	for _, limiter := range limiters {
+		if burst := limiter.Burst(); burst < size {
+			size = burst
+		}
+	}
+	return size
+}
+
+func (t *Tunnel) copy(ctx context.Context, dst, src net.Conn, counter *int64, limiters []*ratelimit.Limiter, metric prometheus.Counter) error {
+	_, dstTCP := dst.(*net.TCPConn)
+	srcConn, srcTCP := src.(*net.TCPConn)
+	if dstTCP && srcTCP {
+		chunk := chunkSize(spliceChunk, limiters)
+		return t.relay(ctx, dst, src, counter, limiters, metric, func() (int64, error) {
+			n, err := readable(srcConn)
+			if err != nil {
+				return 0, err
+			}
+			if n <= 0 || n > chunk {
+				n = chunk
+			}
+			return io.CopyN(dst, src, n)
+		})
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	b := (*buf)[:chunkSize(int64(len(*buf)), limiters)]
+	return t.relay(ctx, dst, src, counter, limiters, metric, func() (int64, error) {
+		n, err := src.Read(b)
+		if n > 0 {
+			if _, err := dst.Write(b[:n]); err != nil {
+				return 0, err
+			}
+		}
+		return int64(n), err
+	})
+}
+
+func (t *Tunnel) relay(ctx context.Context, dst, src net.Conn, counter *int64, limiters []*ratelimit.Limiter, metric prometheus.Counter, step func() (int64, error)) error {
+	for {
+		if t.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(t.IdleTimeout / 2))
+		}
+		n, err := step()
+		if n > 0 {
+			atomic.StoreInt64(&t.active, time.Now().UnixNano())
+			atomic.AddInt64(counter, n)
+			metric.Add(float64(n))
+			for _, limiter := range limiters {
+				if e := limiter.WaitN(ctx, n); e != nil {
+					return e
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil || t.idle(err) {
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Close("idle timeout")
+		}
+		return err
+	}
+}
@@ -0,0 +1,236 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+type plainConn struct {
+	net.Conn
+}
+
+type relay func(client, upstream net.Conn)
+
+func init() {
+	AccessLogger = logrus.New()
+	AccessLogger.SetOutput(ioutil.Discard)
+}
+
+func listen(t testing.TB) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func tunnelRelay(wrap func(net.Conn) net.Conn) relay {
+	return func(client, upstream net.Conn) {
+		New(context.Background(), "bench", "direct", "sink", wrap(client), wrap(upstream)).Run(context.Background())
+	}
+}
+
+func copyRelay(client, upstream net.Conn) {
+	go func() {
+		io.Copy(client, upstream)
+		client.Close()
+	}()
+	io.Copy(upstream, client)
+	upstream.Close()
+}
+
+func benchmarkRelay(b *testing.B, r relay) {
+	sink := listen(b)
+	defer sink.Close()
+	done := make(chan int64, 1)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, conn)
+		conn.Close()
+		done <- n
+	}()
+
+	front := listen(b)
+	defer front.Close()
+	go func() {
+		client, err := front.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", sink.Addr().String())
+		if err != nil {
+			client.Close()
+			return
+		}
+		r(client, upstream)
+	}()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 128*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if n := <-done; n != int64(b.N*len(buf)) {
+		b.Fatalf("relayed %d bytes, want %d", n, b.N*len(buf))
+	}
+}
+
+func BenchmarkTunnelSplice(b *testing.B) {
+	benchmarkRelay(b, tunnelRelay(func(conn net.Conn) net.Conn {
+		return conn
+	}))
+}
+
+func BenchmarkTunnelBuffered(b *testing.B) {
+	benchmarkRelay(b, tunnelRelay(func(conn net.Conn) net.Conn {
+		return plainConn{conn}
+	}))
+}
+
+func BenchmarkCopy(b *testing.B) {
+	benchmarkRelay(b, copyRelay)
+}
+
+func TestIdleTimeoutKeepsSlowTunnel(t *testing.T) {
+	target := listen(t)
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < 20; i++ {
+			if _, err := conn.Write([]byte{'.'}); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	front := listen(t)
+	defer front.Close()
+	reason := make(chan string, 1)
+	go func() {
+		client, err := front.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", target.Addr().String())
+		if err != nil {
+			client.Close()
+			return
+		}
+		tunnel := New(context.Background(), "test", "direct", "target", client, upstream)
+		tunnel.IdleTimeout = 200 * time.Millisecond
+		tunnel.Run(context.Background())
+		reason <- tunnel.Reason()
+	}()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	n, _ := io.Copy(ioutil.Discard, conn)
+	if n != 20 {
+		t.Fatalf("received %d bytes, want 20", n)
+	}
+	if r := <-reason; r == "idle timeout" {
+		t.Fatalf("active tunnel closed with %q", r)
+	}
+}
+
+func TestSpliceCountsPartialChunks(t *testing.T) {
+	target := listen(t)
+	defer target.Close()
+	release := make(chan struct{})
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		<-release
+	}()
+
+	front := listen(t)
+	defer front.Close()
+	tunnels := make(chan *Tunnel, 1)
+	go func() {
+		client, err := front.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", target.Addr().String())
+		if err != nil {
+			client.Close()
+			return
+		}
+		tunnel := New(context.Background(), "test", "direct", "target", client, upstream)
+		tunnels <- tunnel
+		tunnel.Run(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := <-tunnels
+	deadline := time.Now().Add(time.Second)
+	for tunnel.Download() != 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	if n := tunnel.Download(); n != 5 {
+		t.Fatalf("download counter is %d while the tunnel is open, want 5", n)
+	}
+}
+
+func TestReasonWhileClosing(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	upstream, upstreamPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer upstreamPeer.Close()
+	tunnel := New(context.Background(), "test", "direct", "target", client, upstream)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunnel.Run(context.Background())
+	}()
+	go tunnel.Close("closed by admin")
+	for {
+		select {
+		case <-done:
+			if r := tunnel.Reason(); r != "closed by admin" {
+				t.Fatalf("reason %q, want %q", r, "closed by admin")
+			}
+			return
+		default:
+			tunnel.Reason()
+		}
+	}
+}